@@ -0,0 +1,67 @@
+//go:build !windows
+
+package sshforward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// defaultAgentSocket returns the agent socket used when none is given.
+func defaultAgentSocket() string {
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// dialAgentSocket connects to the agent's UNIX socket, bounding each request
+// by timeout unless it's zero.
+func dialAgentSocket(socket string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	fi, err := os.Stat(socket)
+	if err != nil {
+		return nil, fmt.Errorf("agent socket %v: %v", socket, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("agent socket %v is not a socket", socket)
+	}
+
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &agentConn{Conn: conn, timeout: timeout}, nil
+}
+
+// agentConn bounds each request to the agent by timeout, unless it's zero.
+// The agent client writes each request in one go and then reads the response,
+// so each write sets the deadline for both. A request that times out closes the
+// connection as a late response would be mistaken for that of the next request.
+type agentConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *agentConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	n, err := c.Conn.Write(p)
+	return n, c.timedOut(err)
+}
+
+func (c *agentConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	return n, c.timedOut(err)
+}
+
+// timedOut closes the connection if err is a timeout, replacing it with a
+// clearer error.
+func (c *agentConn) timedOut(err error) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	c.Conn.Close()
+	return agentTimeoutError(c.timeout)
+}
@@ -0,0 +1,103 @@
+//go:build windows
+
+package sshforward
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// openSSHAgentPipe is the named pipe of the Windows OpenSSH agent service.
+// Pageant from PuTTY 0.75 on can serve the same protocol on a named pipe of
+// its own, given with -agent-sock.
+const openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// defaultAgentSocket returns the agent pipe used when none is given.
+func defaultAgentSocket() string {
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		return socket
+	}
+	return openSSHAgentPipe
+}
+
+// dialAgentSocket opens the agent's named pipe, bounding each request by
+// timeout unless it's zero.
+func dialAgentSocket(socket string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	name, err := windows.UTF16PtrFromString(socket)
+	if err != nil {
+		return nil, err
+	}
+	// overlapped so reads and writes can be abandoned once they time out.
+	h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+	if err == windows.ERROR_FILE_NOT_FOUND {
+		return nil, fmt.Errorf("agent pipe %v doesn't exist, is the ssh-agent service running?", socket)
+	} else if err != nil {
+		return nil, fmt.Errorf("agent pipe %v: %v", socket, err)
+	}
+	return &pipeConn{h: h, timeout: timeout}, nil
+}
+
+// pipeConn is a connection to the agent's named pipe. Each read and write is
+// abandoned after timeout, unless it's zero, closing the pipe as a late
+// response would be mistaken for that of the next request.
+type pipeConn struct {
+	h       windows.Handle
+	timeout time.Duration
+	close   sync.Once
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	n, err := c.do(p, windows.ReadFile)
+	if err == windows.ERROR_BROKEN_PIPE {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.do(p, windows.WriteFile)
+}
+
+func (c *pipeConn) Close() error {
+	var err error
+	c.close.Do(func() {
+		err = windows.CloseHandle(c.h)
+	})
+	return err
+}
+
+// do runs the overlapped read or write op on p, waiting up to the timeout for
+// it to complete.
+func (c *pipeConn) do(p []byte, op func(windows.Handle, []byte, *uint32, *windows.Overlapped) error) (int, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+
+	o := &windows.Overlapped{HEvent: event}
+	var n uint32
+	err = op(c.h, p, &n, o)
+	if err != windows.ERROR_IO_PENDING {
+		return int(n), err
+	}
+
+	wait := uint32(windows.INFINITE)
+	if c.timeout > 0 {
+		wait = uint32(c.timeout.Milliseconds())
+	}
+	if ret, _ := windows.WaitForSingleObject(event, wait); ret == uint32(windows.WAIT_TIMEOUT) {
+		windows.CancelIoEx(c.h, o)
+		// the cancelled op still writes to o and p until it completes.
+		windows.GetOverlappedResult(c.h, o, &n, true)
+		c.Close()
+		return 0, agentTimeoutError(c.timeout)
+	}
+	err = windows.GetOverlappedResult(c.h, o, &n, true)
+	return int(n), err
+}
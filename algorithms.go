@@ -0,0 +1,42 @@
+package sshforward
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The algorithms golang.org/x/crypto/ssh implements, which a host's ciphers,
+// macs and key_exchanges are restricted to.
+var (
+	supportedCiphers = []string{
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc",
+		"arcfour256", "arcfour128", "arcfour",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+	supportedKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	}
+)
+
+// validateAlgorithms returns an error naming the first of names that isn't
+// one of the supported algorithms of kind.
+func validateAlgorithms(kind string, names, supported []string) error {
+outer:
+	for _, name := range names {
+		for _, s := range supported {
+			if name == s {
+				continue outer
+			}
+		}
+		return fmt.Errorf("unsupported %v %q, expected one of %v", kind, name, strings.Join(supported, ", "))
+	}
+	return nil
+}
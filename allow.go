@@ -0,0 +1,64 @@
+package sshforward
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// allowList is the networks an endpoint accepts connections from, nil allows
+// every source.
+type allowList []netip.Prefix
+
+// parseAllowList parses CIDRs such as 10.0.0.0/8, a bare IP address allowing
+// just that address. IPv4-mapped CIDRs such as ::ffff:10.0.0.0/104 are
+// converted to their IPv4 equivalent, so must be at least /96.
+func parseAllowList(specs []string) (allowList, error) {
+	var list allowList
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			addr, err := netip.ParseAddr(spec)
+			if err != nil {
+				return nil, fmt.Errorf("allow %q isn't a CIDR or IP address", spec)
+			}
+			addr = addr.Unmap()
+			list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, fmt.Errorf("allow %q isn't a CIDR or IP address", spec)
+		}
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				return nil, fmt.Errorf("allow %q covers more than the IPv4-mapped addresses, use a prefix of at least /96", spec)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		if !prefix.IsValid() {
+			return nil, fmt.Errorf("allow %q isn't a valid CIDR", spec)
+		}
+		list = append(list, prefix.Masked())
+	}
+	return list, nil
+}
+
+// allows reports whether connections from addr are accepted. Addresses that
+// aren't IP addresses are only allowed by an empty list.
+func (a allowList) allows(addr net.Addr) bool {
+	if len(a) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, prefix := range a {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
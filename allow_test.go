@@ -0,0 +1,46 @@
+package sshforward
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAllowList(t *testing.T) {
+	tests := []struct {
+		spec    string
+		allowed []string
+		denied  []string
+	}{
+		{"10.0.0.0/8", []string{"10.1.2.3"}, []string{"11.0.0.1"}},
+		{"192.168.1.5", []string{"192.168.1.5"}, []string{"192.168.1.6"}},
+		{"::ffff:10.0.0.0/104", []string{"10.1.2.3", "::ffff:10.1.2.3"}, []string{"11.0.0.1"}},
+		{"::ffff:0.0.0.0/96", []string{"10.1.2.3", "192.168.1.5"}, []string{"::1"}},
+		{"::ffff:192.168.1.5", []string{"192.168.1.5"}, []string{"192.168.1.6"}},
+		{"fd00::/8", []string{"fd00::1"}, []string{"10.1.2.3", "fe80::1"}},
+	}
+	for _, tt := range tests {
+		list, err := parseAllowList([]string{tt.spec})
+		if err != nil {
+			t.Errorf("parseAllowList(%q) = %v", tt.spec, err)
+			continue
+		}
+		for _, ip := range tt.allowed {
+			if !list.allows(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1}) {
+				t.Errorf("%q doesn't allow %v", tt.spec, ip)
+			}
+		}
+		for _, ip := range tt.denied {
+			if list.allows(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1}) {
+				t.Errorf("%q allows %v", tt.spec, ip)
+			}
+		}
+	}
+}
+
+func TestParseAllowListInvalid(t *testing.T) {
+	for _, spec := range []string{"::ffff:0:0/64", "::ffff:10.0.0.0/95", "10.0.0.0/33", "example.com", "10.0.0.0/"} {
+		if _, err := parseAllowList([]string{spec}); err == nil {
+			t.Errorf("parseAllowList(%q) succeeded, want an error", spec)
+		}
+	}
+}
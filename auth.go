@@ -0,0 +1,324 @@
+package sshforward
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// passphraseEnv is consulted for the passphrase of encrypted private keys
+// before falling back to an interactive prompt.
+const passphraseEnv = "SSHFORWARD_PASSPHRASE"
+
+// passwordEnv is consulted for the password of hosts that require password
+// authentication before falling back to an interactive prompt.
+const passwordEnv = "SSHFORWARD_PASSWORD"
+
+// DialAgent connects to the ssh-agent at socket or, when socket is empty,
+// $SSH_AUTH_SOCK or the platform's default. That's a UNIX socket except on
+// Windows, where it's a named pipe defaulting to the OpenSSH agent's. Unless
+// timeout is zero, an agent that doesn't respond to a request within it, such
+// as one behind a stale socket, is disconnected so authentication falls back
+// to the other methods rather than hanging. The connection is checked by
+// listing the agent's keys.
+func DialAgent(socket string, timeout time.Duration) (agent.Agent, error) {
+	if socket == "" {
+		socket = defaultAgentSocket()
+	}
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set, set it or use -agent-sock")
+	}
+
+	conn, err := dialAgentSocket(socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client := agent.NewClient(conn)
+	if _, err := client.List(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("agent socket %v: %v", socket, err)
+	}
+	return client, nil
+}
+
+// agentTimeoutError is returned by requests to an agent that didn't respond
+// within timeout.
+func agentTimeoutError(timeout time.Duration) error {
+	return fmt.Errorf("ssh-agent didn't respond within %v", timeout)
+}
+
+// forwardAgent makes keyring available on the host for the lifetime of client
+// by requesting agent forwarding on an otherwise idle session.
+func forwardAgent(client *ssh.Client, keyring agent.Agent) error {
+	if err := agent.ForwardToAgent(client, keyring); err != nil {
+		return err
+	}
+
+	// the session is closed along with the client.
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		session.Close()
+		return err
+	}
+	return nil
+}
+
+// AuthMethods returns the auth methods available from the agent, which may be
+// nil, and the private key signers.
+func AuthMethods(agentClient agent.Agent, keySigners []ssh.Signer) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if agentClient != nil || len(keySigners) > 0 {
+		// Use a callback rather than PublicKeys so we only consult the
+		// agent once the remote server wants it. The agent and key file
+		// signers share a single method as the client won't retry
+		// publickey auth once it has failed.
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var signers []ssh.Signer
+			if agentClient != nil {
+				var err error
+				signers, err = agentClient.Signers()
+				if err != nil {
+					slog.Warn("ssh-agent signers error", "error", err)
+				}
+			}
+			return append(signers, keySigners...), nil
+		}))
+	}
+
+	return methods
+}
+
+// PasswordPrompt provides the password and keyboard-interactive auth methods,
+// reading responses from $SSHFORWARD_PASSWORD or the terminal. Prompts are
+// serialised so hosts dialled concurrently don't interleave on the terminal.
+type PasswordPrompt struct {
+	mu sync.Mutex
+}
+
+// NewPasswordPrompt returns a prompt if passwords can be read, either because
+// $SSHFORWARD_PASSWORD is set or stdin is a terminal, otherwise nil. When
+// force is set and passwords can't be read an error is returned.
+func NewPasswordPrompt(force bool) (*PasswordPrompt, error) {
+	_, ok := os.LookupEnv(passwordEnv)
+	if ok || term.IsTerminal(int(os.Stdin.Fd())) {
+		return &PasswordPrompt{}, nil
+	}
+	if force {
+		return nil, fmt.Errorf("passwords can't be read, set %v or run from a terminal", passwordEnv)
+	}
+	return nil, nil
+}
+
+// methods returns the password auth methods for user@addr, or nil if p is nil.
+// They're tried after publickey auth as the server allows.
+func (p *PasswordPrompt) methods(user, addr string) []ssh.AuthMethod {
+	if p == nil {
+		return nil
+	}
+
+	return []ssh.AuthMethod{
+		ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			return p.challenge(user, addr, instruction, questions, echos)
+		}),
+		ssh.PasswordCallback(func() (string, error) {
+			answers, err := p.challenge(user, addr, "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return "", err
+			}
+			return answers[0], nil
+		}),
+	}
+}
+
+// challenge answers each of questions, echoing the answer as the
+// corresponding entry in echos requests. A single hidden question is assumed
+// to be the password and answered from $SSHFORWARD_PASSWORD when it's set.
+func (p *PasswordPrompt) challenge(user, addr, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) == 1 && !echos[0] {
+		if password, ok := os.LookupEnv(passwordEnv); ok {
+			return []string{password}, nil
+		}
+	}
+	if len(questions) == 0 {
+		return nil, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("password required, set %v or run from a terminal", passwordEnv)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "Authenticating %v@%v\n", user, addr)
+	if instruction != "" {
+		fmt.Fprintln(os.Stderr, instruction)
+	}
+
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		fmt.Fprint(os.Stderr, question)
+		answer, err := readLine(fd, echos[i])
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+// readLine reads a line from the terminal fd, without echo unless echo is set.
+func readLine(fd int, echo bool) (string, error) {
+	if !echo {
+		line, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(line), err
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stderr}, "")
+	return t.ReadLine()
+}
+
+// LoadSigners parses each of the private key files into a signer. Each of the
+// certificate files, and any <key>-cert.pub found beside a key as ssh does, is
+// paired with the key it certifies and offered ahead of the plain keys.
+func LoadSigners(filenames, certFiles []string) ([]ssh.Signer, error) {
+	var keys []ssh.Signer
+	for _, filename := range filenames {
+		signer, err := loadSigner(filename)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+		keys = append(keys, signer)
+	}
+
+	var signers []ssh.Signer
+	for _, filename := range certFiles {
+		signer, err := loadCertSigner(filename, keys)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+		signers = append(signers, signer)
+	}
+	for i, filename := range filenames {
+		certFile := filename + "-cert.pub"
+		if _, err := os.Stat(certFile); err != nil || contains(certFiles, certFile) {
+			continue
+		}
+		signer, err := loadCertSigner(certFile, keys[i:i+1])
+		if err != nil {
+			slog.Warn("Ignoring certificate", "file", certFile, "error", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return append(signers, keys...), nil
+}
+
+// loadCertSigner parses a user certificate file, as written by ssh-keygen -s,
+// into a signer presenting it with whichever of keys it certifies.
+func loadCertSigner(filename string, keys []ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+
+	logger := slog.With("file", filename, "key_id", cert.KeyId)
+	if now := uint64(time.Now().Unix()); now >= cert.ValidBefore && cert.ValidBefore != ssh.CertTimeInfinity {
+		logger.Warn("Certificate has expired", "valid_before", time.Unix(int64(cert.ValidBefore), 0))
+	}
+
+	certified := cert.Key.Marshal()
+	for _, key := range keys {
+		if bytes.Equal(key.PublicKey().Marshal(), certified) {
+			logger.Debug("Loaded certificate", "principals", cert.ValidPrincipals)
+			return ssh.NewCertSigner(cert, key)
+		}
+	}
+	return nil, errors.New("certificate doesn't match any -i key")
+}
+
+// contains reports whether s is one of values.
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSigner parses a private key file, decrypting it with a passphrase from
+// the environment or the terminal when required.
+func loadSigner(filename string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+
+	passphrase, err := readPassphrase(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+}
+
+// readPassphrase returns the passphrase for filename from $SSHFORWARD_PASSPHRASE
+// or by prompting on the terminal without echo.
+func readPassphrase(filename string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("key is encrypted, set %v or run from a terminal", passphraseEnv)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %v: ", filename)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package sshforward
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setBacklog sets the listen backlog of l. Go listens with the kernel's
+// largest backlog, so the socket is listened on again, which on Linux and the
+// BSDs updates the backlog of a listening socket. The kernel still caps it.
+func setBacklog(l net.Listener, backlog int) error {
+	conn, ok := l.(syscall.Conn)
+	if !ok {
+		return errors.New("listener has no socket")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package sshforward
+
+import (
+	"errors"
+	"net"
+)
+
+// setBacklog fails as Windows ignores a second listen on a socket, leaving no
+// way to change the backlog Go listens with.
+func setBacklog(l net.Listener, backlog int) error {
+	return errors.New("the listen backlog can't be set on Windows")
+}
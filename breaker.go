@@ -0,0 +1,107 @@
+package sshforward
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Breaker describes when an endpoint stops dialling its target after
+// consecutive failures.
+type Breaker struct {
+	// Failures is the number of consecutive dial failures that open the
+	// breaker, zero disables it.
+	Failures int
+	// Cooldown is how long connections are rejected once it's open, before a
+	// single connection is let through to try the target again.
+	Cooldown time.Duration
+}
+
+// breaker rejects connections to an endpoint while its target is failing.
+// A nil breaker allows every connection.
+type breaker struct {
+	Breaker
+
+	mu       sync.Mutex
+	failures int
+	// openUntil is when the cooldown ends, zero while the breaker is closed.
+	openUntil time.Time
+	// probing is set while the connection let through after the cooldown
+	// dials.
+	probing bool
+}
+
+// newBreaker returns a breaker for b, or nil when b is disabled.
+func newBreaker(b Breaker) *breaker {
+	if b.Failures <= 0 {
+		return nil
+	}
+	return &breaker{Breaker: b}
+}
+
+// allow reports whether a connection may dial the target. Once the cooldown
+// has passed one connection is allowed, the rest are rejected until its dial
+// succeeds.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// succeeded records a successful dial, closing the breaker. It reports whether
+// the breaker was open.
+func (b *breaker) succeeded() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := !b.openUntil.IsZero()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+	return wasOpen
+}
+
+// failed records a failed dial, reporting whether it opened the breaker.
+func (b *breaker) failed() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures < b.Failures {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.Cooldown)
+	return true
+}
+
+// dialled records a successful dial of addr, logging if it closed the breaker.
+func (b *breaker) dialled(logger *slog.Logger, addr string) {
+	if b.succeeded() {
+		logger.Info("Target recovered, accepting connections", "address", addr)
+	}
+}
+
+// dialFailed records a failed dial of addr, logging if it opened the breaker.
+func (b *breaker) dialFailed(logger *slog.Logger, addr string) {
+	if b.failed() {
+		logger.Warn("Target failing, rejecting connections", "address", addr, "failures", b.Failures, "cooldown", b.Cooldown)
+	}
+}
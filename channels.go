@@ -0,0 +1,154 @@
+package sshforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// channelClient is an ssh client that counts the channels carrying forwarded
+// connections and bounds those it opens. Each forwarded connection needs its
+// own channel, the ssh protocol has no way to reuse one for another
+// connection.
+type channelClient struct {
+	// Client is nil for a local host.
+	*ssh.Client
+	// limit bounds the channels opened by dial, nil is unlimited.
+	limit limiter
+	stats *hostStats
+	// dialTimeout bounds each dial, see Options.TargetDialTimeout.
+	dialTimeout time.Duration
+}
+
+// dial opens a channel to addr through the host, waiting for a free channel
+// while the limit is reached until ctx is done. A host name in addr is sent as
+// is and resolved by the host, so names that only resolve there can be used.
+// The port must be numeric. Without an ssh client addr is dialled directly.
+// The dial fails after dialTimeout.
+func (c *channelClient) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.Client == nil {
+		return dialTarget(ctx, nil, network, addr, c.dialTimeout)
+	}
+
+	released, ok := c.limit.wait(ctx)
+	if !ok {
+		return nil, ctx.Err()
+	}
+
+	conn, err := dialTarget(ctx, c.Client, network, addr, c.dialTimeout)
+	if err != nil {
+		released()
+		return nil, err
+	}
+	return c.track(conn, released), nil
+}
+
+// dialTarget dials addr through client, or directly when it's nil, failing
+// once timeout passes, unless it's zero, or ctx is done. ssh.Client.Dial can't
+// be cancelled, so a channel it opens after giving up is closed.
+func dialTarget(ctx context.Context, client *ssh.Client, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var conn net.Conn
+	var err error
+	if client == nil {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+	} else {
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			conn, err := client.Dial(network, addr)
+			done <- result{conn, err}
+		}()
+
+		select {
+		case r := <-done:
+			conn, err = r.conn, r.err
+		case <-ctx.Done():
+			go func() {
+				if r := <-done; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+			err = ctx.Err()
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("dial %v timed out after %v", addr, timeout)
+	}
+	return conn, err
+}
+
+// listen asks the host to listen on addr. The channels of accepted
+// connections are opened by the host, so they're counted but not limited.
+// Unlike dial, ssh.Client.Listen resolves a host name in addr locally.
+func (c *channelClient) listen(network, addr string) (net.Listener, error) {
+	if c.Client == nil {
+		return nil, errors.New("remote endpoints need an ssh host")
+	}
+	l, err := c.Client.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &channelListener{Listener: l, client: c}, nil
+}
+
+// track counts conn as an open channel until it's closed, at which point
+// released is called.
+func (c *channelClient) track(conn net.Conn, released func()) net.Conn {
+	closed := c.stats.channelOpened()
+	return &channelConn{Conn: conn, closed: func() {
+		closed()
+		released()
+	}}
+}
+
+// channelListener counts the channels of the connections it accepts.
+type channelListener struct {
+	net.Listener
+	client *channelClient
+}
+
+func (l *channelListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.client.track(conn, func() {}), nil
+}
+
+// channelConn is a forwarded connection's channel, calling closed once when
+// it's closed.
+type channelConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *channelConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closed)
+	return err
+}
+
+// CloseWrite half-closes the channel.
+func (c *channelConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// connFDs is the file descriptors each forwarded connection may need, the
+	// accepted connection and, for local hosts and remote endpoints, the
+	// dialled one.
+	connFDs = 2
+	// spareFDs is reserved for the ssh connections, the HTTP server and the
+	// like, and when there's no -max-conns, the least left for connections.
+	spareFDs = 256
+	// minSomaxconn is the listen backlog below which a warning is logged.
+	minSomaxconn = 1024
+)
+
+// checkLimits raises the soft limit on open files to the hard limit, should
+// the runtime not have already, and warns if it's too low for listeners
+// listeners and maxConns connections, or if the kernel caps the listen backlog
+// low or below backlog, the -listen-backlog asked for.
+func checkLimits(listeners, maxConns, backlog int) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		slog.Warn("Failed to read the open file limit", "error", err)
+		return
+	}
+	if limit.Cur < limit.Max {
+		raised := limit
+		raised.Cur = limit.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err == nil {
+			limit = raised
+		}
+	}
+
+	needed := uint64(listeners + spareFDs)
+	if maxConns > 0 {
+		needed += uint64(maxConns * connFDs)
+	}
+	// Rlimit's fields are signed on some BSDs.
+	if cur := uint64(limit.Cur); cur < needed {
+		slog.Warn("Open file limit is low, connections may fail to be accepted", "limit", cur, "listeners", listeners, "max_conns", maxConns, "recommended", needed)
+	}
+
+	if largest, ok := somaxconn(); ok && backlog > largest {
+		slog.Warn("-listen-backlog is capped by net.core.somaxconn", "listen_backlog", backlog, "somaxconn", largest)
+	} else if ok && backlog == 0 && largest < minSomaxconn {
+		slog.Warn("Listen backlog is low, raise net.core.somaxconn", "somaxconn", largest)
+	}
+}
+
+// somaxconn returns the kernel's cap on the listen backlog, which Go uses for
+// every listener without -listen-backlog. It's only known on Linux.
+func somaxconn() (int, bool) {
+	data, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n, err == nil
+}
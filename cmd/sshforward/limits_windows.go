@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+// checkLimits does nothing on Windows, which has no open file limit to raise
+// and no way to read the listen backlog.
+func checkLimits(listeners, maxConns, backlog int) {}
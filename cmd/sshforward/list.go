@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nfisher/sshforward"
+)
+
+// list describes the hosts and endpoints in the config without connecting to
+// any of them. Problems found validating the config are listed after it.
+func list(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	var filenames stringList
+	var format string
+	var configHeaders stringList
+	var tags string
+
+	fs.Var(&filenames, "f", "file containing environment hosts and endpoints, - for stdin, an http:// or https:// URL, or a directory or glob of files. May be repeated to merge several files. (required)")
+	fs.StringVar(&format, "format", "", "config file format, json, yaml or toml. (default from the file extension)")
+	fs.Var(&configHeaders, "config-header", "header sent when fetching a config URL, e.g. \"Authorization: Bearer $TOKEN\". May be repeated.")
+	fs.BoolVar(&sshforward.ConfigInsecureSkipVerify, "config-insecure", false, "skip verifying the certificate of https:// config URLs. (not recommended)")
+	fs.StringVar(&tags, "tags", "", "comma separated tags, endpoints without one of them are listed as disabled.")
+	fs.Parse(args)
+
+	if len(filenames) == 0 {
+		fs.Usage()
+		return
+	}
+	if err := setConfigHeaders(configHeaders); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -config-header: %v\n", err)
+		os.Exit(2)
+	}
+
+	config, err := sshforward.LoadConfigs(filenames, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	config.FilterTags(splitTags(tags))
+	describe(os.Stdout, config)
+
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nInvalid config:\n%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// describe writes a table of config's hosts and endpoints to w.
+func describe(w io.Writer, config sshforward.Config) {
+	fmt.Fprintf(w, "Environment: %v\n\n", config.Environment)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tADDRESS\tENDPOINT\tDIRECTION\tLOCAL\tREMOTE")
+	for _, host := range config.Hosts {
+		hostName := host.Name
+		if !host.IsEnabled() {
+			hostName += " (disabled)"
+		}
+		address := host.HostPort()
+		if host.User != "" {
+			address = host.User + "@" + address
+		}
+		if host.Jump != "" {
+			address += " via " + host.Jump
+		}
+
+		if len(host.Endpoints) == 0 && host.Socks == "" {
+			fmt.Fprintf(tw, "%v\t%v\t-\t\t\t\n", hostName, address)
+		}
+		for _, endpoint := range host.Endpoints {
+			endpointName := endpoint.Name
+			if !endpoint.IsEnabled() {
+				endpointName += " (disabled)"
+			}
+			direction := endpoint.Direction
+			if direction == "" {
+				direction = sshforward.DirectionLocal
+			}
+			if endpoint.Protocol == sshforward.ProtocolUDP {
+				direction += "/udp"
+			}
+			arrow := "->"
+			if direction == sshforward.DirectionRemote {
+				arrow = "<-"
+			}
+			local := strings.Join(append([]string{endpoint.LocalAddr}, endpoint.LocalAddrs...), ",")
+			remote := strings.Join(append([]string{endpoint.RemoteAddr}, endpoint.RemoteAddrs...), ",")
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v %v\t%v\n", hostName, address, endpointName, direction, local, arrow, remote)
+		}
+		if host.Socks != "" {
+			fmt.Fprintf(tw, "%v\t%v\tsocks\t%v\t%v ->\t*\n", hostName, address, sshforward.DirectionLocal, host.Socks)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Log output formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// setupLogging sets the default logger to write entries at level and above in
+// format. The text format keeps the standard log output, with each entry's
+// attributes as key=value pairs.
+func setupLogging(format, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+
+	switch format {
+	case "", LogFormatText:
+		slog.SetLogLoggerLevel(l)
+		return nil
+	case LogFormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// setEnvironment adds the environment to every subsequent log entry, replacing
+// any environment set before.
+func setEnvironment(environment string) {
+	if baseLogger == nil {
+		baseLogger = slog.Default()
+	}
+	logger := baseLogger
+	if environment != "" {
+		logger = logger.With("environment", environment)
+	}
+	slog.SetDefault(logger)
+}
+
+// baseLogger is the default logger without an environment.
+var baseLogger *slog.Logger
+
+// fatal logs msg as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
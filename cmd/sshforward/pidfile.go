@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// pidFile is a file holding the process ID, locked for as long as the process
+// runs so a second instance using it refuses to start.
+type pidFile struct {
+	f *os.File
+}
+
+// openPIDFile locks the file at path and writes the process ID to it. The lock
+// is released when the process exits, so a file left by one that crashed
+// doesn't block the next.
+func openPIDFile(path string) (*pidFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		defer f.Close()
+		if errors.Is(err, errLocked) {
+			if pid, _ := readPID(f); pid != 0 {
+				return nil, fmt.Errorf("%v is in use, sshforward is already running as pid %v", path, pid)
+			}
+			return nil, fmt.Errorf("%v is in use, sshforward is already running", path)
+		}
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pidFile{f: f}, nil
+}
+
+// readPID returns the process ID in f, zero if it has none.
+func readPID(f *os.File) (int, error) {
+	buf := make([]byte, 32)
+	n, err := f.ReadAt(buf, 0)
+	if n == 0 {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(buf[:n])))
+}
+
+// remove releases the lock and deletes the file, doing nothing if p is nil. It's
+// closed first as Windows can't remove an open file.
+func (p *pidFile) remove() {
+	if p == nil {
+		return
+	}
+	p.f.Close()
+	if err := os.Remove(p.f.Name()); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove pid file", "file", p.f.Name(), "error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nfisher/sshforward"
+)
+
+// readyPollInterval is how often the tunnels are checked while waiting for
+// them to come up.
+const readyPollInterval = 100 * time.Millisecond
+
+// signalReady waits until every host is connected and every endpoint is
+// listening, then announces it by writing READY to stdout when path is "-" or
+// to the file at path otherwise. Nothing is written when path is empty.
+func signalReady(ctx context.Context, t *sshforward.Tunnels, path string) {
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	for !t.Healthy() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	slog.Info("All tunnels are up")
+	switch path {
+	case "":
+	case "-":
+		fmt.Println("READY")
+	default:
+		if err := os.WriteFile(path, []byte("READY\n"), 0644); err != nil {
+			slog.Error("Failed to write ready file", "file", path, "error", err)
+		}
+	}
+}
+
+// clearReady removes the ready file written by signalReady, if any.
+func clearReady(path string) {
+	if path == "" || path == "-" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove ready file", "file", path, "error", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+
+	"github.com/nfisher/sshforward"
+)
+
+// udpRelay runs the remote side of udp endpoints, relaying the datagrams of
+// each session it accepts to a UDP service.
+func udpRelay(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	var listenAddr string
+	var target string
+
+	fs.StringVar(&listenAddr, "listen", "127.0.0.1:5300", "TCP address to accept udp endpoint sessions on, the endpoint's remote address.")
+	fs.StringVar(&target, "target", "", "address of the UDP service datagrams are relayed to. (required)")
+	fs.Parse(args)
+
+	if target == "" {
+		fs.Usage()
+		return
+	}
+
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		fatal("Failed to listen", "error", err)
+	}
+	slog.Info("Relaying UDP", "address", l.Addr().String(), "target", target)
+	fatal("Relay failed", "error", sshforward.RelayUDP(l, target))
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignal has the status of every host and endpoint logged.
+var statusSignal os.Signal = syscall.SIGUSR1
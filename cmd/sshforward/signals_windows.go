@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// statusSignal is nil as Windows has no SIGUSR1, the status is only served
+// over HTTP.
+var statusSignal os.Signal
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/nfisher/sshforward"
+)
+
+// logStatus logs the state of every host and endpoint in r, the SIGUSR1
+// alternative to the /status endpoint.
+func logStatus(r sshforward.StatusReport) {
+	slog.Info("Status", "healthy", r.Healthy, "uptime", time.Duration(r.UptimeSeconds)*time.Second, "draining", r.Draining, "active_connections", r.ActiveConns, "hosts", len(r.Hosts))
+	for _, host := range r.Hosts {
+		slog.Info("Host status", "host", host.Name, "address", host.Address, "connected", host.Connected, "open_channels", host.Channels)
+
+		endpoints := host.Endpoints
+		if host.Socks != nil {
+			endpoints = append(endpoints, *host.Socks)
+		}
+		for _, e := range endpoints {
+			slog.Info("Endpoint status", "host", host.Name, "endpoint", e.Name, "listening", e.Listening, "listen_addrs", e.ListenAddrs, "active_connections", e.ActiveConns, "total_connections", e.TotalConns,
+				"local_to_remote", e.BytesLocalToRemote, "remote_to_local", e.BytesRemoteToLocal)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nfisher/sshforward"
+)
+
+// clearScreen moves the cursor home and clears the terminal before each frame.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// top polls the /status endpoint of a running instance, redrawing a table of
+// its endpoints each interval until interrupted.
+func top(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	var httpAddr string
+	var interval time.Duration
+
+	fs.StringVar(&httpAddr, "http-addr", "", "-http-addr of the running sshforward to monitor, e.g. localhost:8080. (required)")
+	fs.DurationVar(&interval, "interval", time.Second, "time between refreshes.")
+	fs.Parse(args)
+
+	if httpAddr == "" {
+		fs.Usage()
+		return
+	}
+	if interval <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -interval, it must be positive\n")
+		os.Exit(2)
+	}
+
+	url := "http://" + httpAddr + "/status"
+	client := &http.Client{Timeout: interval}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last topSample
+	for {
+		var frame bytes.Buffer
+		frame.WriteString(clearScreen)
+		sample, err := fetchStatus(client, url)
+		if err != nil {
+			fmt.Fprintf(&frame, "%v  %v\n\nFailed to fetch status: %v\n", url, time.Now().Format(time.TimeOnly), err)
+		} else {
+			renderTop(&frame, sample, last)
+			last = sample
+		}
+		os.Stdout.Write(frame.Bytes())
+
+		select {
+		case <-sig:
+			fmt.Println()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// topSample is a status report and when it was fetched.
+type topSample struct {
+	report sshforward.StatusReport
+	at     time.Time
+}
+
+// fetchStatus returns the status report served at url.
+func fetchStatus(client *http.Client, url string) (topSample, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return topSample{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return topSample{}, fmt.Errorf("%v: %v", url, resp.Status)
+	}
+
+	var r sshforward.StatusReport
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return topSample{}, err
+	}
+	return topSample{report: r, at: time.Now()}, nil
+}
+
+// renderTop writes a table of the endpoints in s to w, with the throughput of
+// each from the bytes copied since the previous sample last, which include
+// those of connections still open.
+func renderTop(w io.Writer, s, last topSample) {
+	r := s.report
+	health := "healthy"
+	if !r.Healthy {
+		health = "unhealthy"
+	}
+	fmt.Fprintf(w, "Environment: %v  Uptime: %v  %v  %v\n\n", r.Environment, time.Duration(r.UptimeSeconds)*time.Second, health, s.at.Format(time.TimeOnly))
+
+	previous := make(map[string]sshforward.EndpointStatus)
+	for _, host := range last.report.Hosts {
+		for _, e := range topEndpoints(host) {
+			previous[host.Name+"/"+e.Name] = e
+		}
+	}
+	elapsed := s.at.Sub(last.at).Seconds()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tENDPOINT\tSTATUS\tLISTEN\tACTIVE\tTOTAL\tLOCAL->REMOTE\tREMOTE->LOCAL")
+	for _, host := range r.Hosts {
+		endpoints := topEndpoints(host)
+		if len(endpoints) == 0 {
+			fmt.Fprintf(tw, "%v\t-\t%v\t\t\t\t\t\n", host.Name, hostState(host))
+		}
+		for _, e := range endpoints {
+			state := hostState(host)
+			if host.Connected && !e.Listening {
+				state = "not listening"
+			}
+			listen := strings.Join(e.ListenAddrs, ",")
+			if listen == "" {
+				listen = "-"
+			}
+
+			toRemote, toLocal := "-", "-"
+			if p, ok := previous[host.Name+"/"+e.Name]; ok && elapsed > 0 {
+				toRemote = formatRate(float64(e.BytesLocalToRemote-p.BytesLocalToRemote) / elapsed)
+				toLocal = formatRate(float64(e.BytesRemoteToLocal-p.BytesRemoteToLocal) / elapsed)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", host.Name, e.Name, state, listen, e.ActiveConns, e.TotalConns, toRemote, toLocal)
+		}
+	}
+	tw.Flush()
+}
+
+// topEndpoints returns the host's endpoints, and its SOCKS proxy if it has one.
+func topEndpoints(host sshforward.HostStatus) []sshforward.EndpointStatus {
+	endpoints := host.Endpoints
+	if host.Socks != nil {
+		endpoints = append(endpoints[:len(endpoints):len(endpoints)], *host.Socks)
+	}
+	return endpoints
+}
+
+// hostState describes whether host is connected.
+func hostState(host sshforward.HostStatus) string {
+	if host.Connected {
+		return "up"
+	}
+	return "disconnected"
+}
+
+// formatRate formats bytes per second with a binary unit.
+func formatRate(rate float64) string {
+	if rate < 0 {
+		// the counters restart when a reload restarts the host.
+		rate = 0
+	}
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	i := 0
+	for rate >= 1024 && i < len(units)-1 {
+		rate /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %v", rate, units[i])
+	}
+	return fmt.Sprintf("%.1f %v", rate, units[i])
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build details, set with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=...". Those left unset are read from the build info.
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// printVersion prints the version, commit and build date of the binary.
+func printVersion() {
+	v, c, d := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && c == "":
+				c = setting.Value
+			case setting.Key == "vcs.time" && d == "":
+				d = setting.Value
+			case setting.Key == "vcs.modified" && setting.Value == "true" && commit == "":
+				c += "-dirty"
+			}
+		}
+	}
+
+	fmt.Printf("sshforward %v\ncommit: %v\nbuilt: %v\n", orUnknown(v), orUnknown(c), orUnknown(d))
+}
+
+func orUnknown(s string) string {
+	if s == "" || s == "-dirty" {
+		return "unknown"
+	}
+	return s
+}
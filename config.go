@@ -0,0 +1,1174 @@
+package sshforward
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Endpoint directions.
+const (
+	// DirectionLocal forwards connections to LocalAddr on to RemoteAddr.
+	DirectionLocal = "local"
+	// DirectionRemote forwards connections to RemoteAddr on the host back to
+	// LocalAddr.
+	DirectionRemote = "remote"
+)
+
+// Endpoint protocols.
+const (
+	// ProtocolTCP forwards TCP connections, or Unix domain socket connections.
+	ProtocolTCP = "tcp"
+	// ProtocolUDP forwards UDP datagrams from LocalAddr over TCP to RemoteAddr,
+	// see forwardUDP.
+	ProtocolUDP = "udp"
+)
+
+// LocalHost is the address of a host whose endpoints dial their targets
+// directly, without ssh, so plain local proxies can run alongside the tunnels.
+const LocalHost = "local"
+
+// StdioAddr is the local address of an endpoint that forwards the process's
+// stdin and stdout to its remote address, like nc, instead of listening.
+const StdioAddr = "-"
+
+// defaultSSHPort is used for hosts without a port.
+const defaultSSHPort = 22
+
+// unixPrefix marks an endpoint address as the path of a Unix domain socket.
+const unixPrefix = "unix:"
+
+// Endpoint provides the details required to forward remote services to the
+// localhost, or local services to the remote host. Either address may be a
+// Unix domain socket path prefixed with "unix:", e.g. "unix:/tmp/db.sock".
+type Endpoint struct {
+	Name       string `json:"name" yaml:"name" toml:"name"`
+	LocalAddr  string `json:"local" yaml:"local" toml:"local"`
+	RemoteAddr string `json:"remote" yaml:"remote" toml:"remote"`
+	Direction  string `json:"direction,omitempty" yaml:"direction,omitempty" toml:"direction,omitempty"`
+	// LocalAddrs are further addresses a local endpoint listens on alongside
+	// LocalAddr, each forwarded to RemoteAddr.
+	LocalAddrs []string `json:"local_addrs,omitempty" yaml:"local_addrs,omitempty" toml:"local_addrs,omitempty"`
+	// RemoteAddrs are further targets of a local endpoint alongside
+	// RemoteAddr. Connections are spread across them round-robin, skipping
+	// those that recently failed to dial.
+	RemoteAddrs []string `json:"remote_addrs,omitempty" yaml:"remote_addrs,omitempty" toml:"remote_addrs,omitempty"`
+	// Protocol is tcp, the default, or udp. UDP endpoints relay datagrams
+	// over TCP to RemoteAddr, which must speak the framing of forwardUDP.
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty" toml:"protocol,omitempty"`
+	// MaxConns limits the concurrent connections through the endpoint, zero is
+	// unlimited.
+	MaxConns int `json:"max_conns,omitempty" yaml:"max_conns,omitempty" toml:"max_conns,omitempty"`
+	// RateLimit limits the bytes per second copied in each direction, shared
+	// by every connection through the endpoint. Zero is unlimited.
+	RateLimit int `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty" toml:"rate_limit,omitempty"`
+	// DialRetries is the number of times a failed dial of the target is
+	// retried before the accepted connection is closed.
+	DialRetries int `json:"dial_retries,omitempty" yaml:"dial_retries,omitempty" toml:"dial_retries,omitempty"`
+	// WarmConns is the number of connections to the target kept dialled ahead
+	// of need, handed out to accepted connections so they skip the dial. Zero
+	// dials on demand.
+	WarmConns int `json:"warm_conns,omitempty" yaml:"warm_conns,omitempty" toml:"warm_conns,omitempty"`
+	// IdleTimeout closes connections through the endpoint after this many
+	// seconds without data in either direction. Zero disables it.
+	IdleTimeout int `json:"idle_timeout,omitempty" yaml:"idle_timeout,omitempty" toml:"idle_timeout,omitempty"`
+	// TCPKeepAlive overrides -tcp-keepalive, in seconds, for the client
+	// connections accepted by a local endpoint. Zero uses the flag.
+	TCPKeepAlive int `json:"tcp_keepalive,omitempty" yaml:"tcp_keepalive,omitempty" toml:"tcp_keepalive,omitempty"`
+	// Allow restricts the sources connections are accepted from to these
+	// CIDRs or IP addresses. Empty allows every source.
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty" toml:"allow,omitempty"`
+	// ProxyProtocol, v1 or v2, sends each connection's client address to the
+	// target in a PROXY protocol header ahead of its data. Empty sends none.
+	ProxyProtocol string `json:"proxy_protocol,omitempty" yaml:"proxy_protocol,omitempty" toml:"proxy_protocol,omitempty"`
+	// Probe checks the target can be dialled before listening, failing the
+	// endpoint if it can't. A template is probed as expanded for each local
+	// address, so one with {client_host}, which only a connection fills in,
+	// can't be probed.
+	Probe bool `json:"probe,omitempty" yaml:"probe,omitempty" toml:"probe,omitempty"`
+	// Tags label the endpoint so a subset of the config can be started, see
+	// FilterTags.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty" toml:"tags,omitempty"`
+	// Enabled set to false skips the endpoint, it's enabled when unset.
+	Enabled *bool `json:"enabled,omitempty" yaml:"enabled,omitempty" toml:"enabled,omitempty"`
+}
+
+// Host is a host.
+type Host struct {
+	Address   string     `json:"address" yaml:"address" toml:"address"`
+	Endpoints []Endpoint `json:"endpoints" yaml:"endpoints" toml:"endpoints"`
+	Name      string     `json:"name" yaml:"name" toml:"name"`
+	// Port is used when Address has no port, defaulting to 22.
+	Port int `json:"port,omitempty" yaml:"port,omitempty" toml:"port,omitempty"`
+	// User overrides the -u user name for this host.
+	User string `json:"user,omitempty" yaml:"user,omitempty" toml:"user,omitempty"`
+	// Jump names another host, or gives the address of a host, through which
+	// this host is reached. Jump hosts may themselves have a jump.
+	Jump string `json:"jump,omitempty" yaml:"jump,omitempty" toml:"jump,omitempty"`
+	// Socks is the local address of an optional SOCKS5 proxy that tunnels
+	// connections through the host.
+	Socks string `json:"socks,omitempty" yaml:"socks,omitempty" toml:"socks,omitempty"`
+	// MaxChannels limits the channels opened to the host for forwarded
+	// connections, zero is unlimited. Connections wait for a free channel.
+	MaxChannels int `json:"max_channels,omitempty" yaml:"max_channels,omitempty" toml:"max_channels,omitempty"`
+	// ConnectTimeout and KeepaliveInterval in seconds, and KeepaliveMaxMissed,
+	// override -connect-timeout, -keepalive-interval and -keepalive-max-missed
+	// for this host. Zero uses the flag.
+	ConnectTimeout     int `json:"connect_timeout,omitempty" yaml:"connect_timeout,omitempty" toml:"connect_timeout,omitempty"`
+	KeepaliveInterval  int `json:"keepalive_interval,omitempty" yaml:"keepalive_interval,omitempty" toml:"keepalive_interval,omitempty"`
+	KeepaliveMaxMissed int `json:"keepalive_max_missed,omitempty" yaml:"keepalive_max_missed,omitempty" toml:"keepalive_max_missed,omitempty"`
+	// HostKey pins the host's key, as an authorized_keys line or a SHA256
+	// fingerprint, in place of known_hosts.
+	HostKey string `json:"host_key,omitempty" yaml:"host_key,omitempty" toml:"host_key,omitempty"`
+	// Ciphers, MACs and KeyExchanges restrict the algorithms negotiated with
+	// the host, in order of preference. Empty uses the ssh library's defaults.
+	Ciphers      []string `json:"ciphers,omitempty" yaml:"ciphers,omitempty" toml:"ciphers,omitempty"`
+	MACs         []string `json:"macs,omitempty" yaml:"macs,omitempty" toml:"macs,omitempty"`
+	KeyExchanges []string `json:"key_exchanges,omitempty" yaml:"key_exchanges,omitempty" toml:"key_exchanges,omitempty"`
+	// Enabled set to false skips the host, it's enabled when unset. A disabled
+	// host can still be used as a jump host.
+	Enabled *bool `json:"enabled,omitempty" yaml:"enabled,omitempty" toml:"enabled,omitempty"`
+}
+
+// Config provides the full list of hosts and their associated endpoints.
+type Config struct {
+	Environment string `json:"environment" yaml:"environment" toml:"environment"`
+	Hosts       []Host `json:"hosts" yaml:"hosts" toml:"hosts"`
+}
+
+// StdinFilename is the config filename that reads the config from stdin.
+const StdinFilename = "-"
+
+// loadConfig reads the config from filename, stdin when filename is "-" or an
+// http:// or https:// URL, decoding it as format or, when format is empty,
+// according to the file extension.
+func loadConfig(filename, format string) (Config, error) {
+	var config Config
+
+	if format == "" && isConfigURL(filename) {
+		format = formatFromExt(configURLPath(filename))
+	} else if format == "" {
+		format = formatFromExt(filename)
+	}
+
+	var r io.Reader = os.Stdin
+	if isConfigURL(filename) {
+		body, err := fetchConfig(filename)
+		if err != nil {
+			return config, err
+		}
+		defer body.Close()
+		r = body
+	} else if filename != StdinFilename {
+		f, err := os.Open(filename)
+		if err != nil {
+			return config, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return config, fmt.Errorf("%v: %v", filename, err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return config, fmt.Errorf("%v: config file is empty", filename)
+	}
+
+	switch format {
+	case FormatJSON:
+		err = json.NewDecoder(bytes.NewReader(data)).Decode(&config)
+		err = jsonErrorPosition(data, err)
+	case FormatYAML:
+		err = yaml.NewDecoder(bytes.NewReader(data)).Decode(&config)
+	case FormatTOML:
+		_, err = toml.NewDecoder(bytes.NewReader(data)).Decode(&config)
+	default:
+		return config, fmt.Errorf("unknown config format %q", format)
+	}
+	if err != nil {
+		return config, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	config.expandEnv()
+	return config, nil
+}
+
+// jsonErrorPosition prefixes JSON syntax and type errors with the line and
+// column in data they occurred at. The YAML and TOML decoders already include
+// the line.
+func jsonErrorPosition(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("unexpected end of file, is a closing bracket or brace missing?")
+	default:
+		return err
+	}
+
+	// the offset is just past the offending byte.
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		offset--
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %v, column %v: %v", line, column, err)
+}
+
+// LoadConfigs loads each of filenames in turn and merges them into a single
+// config, see merge. A directory or glob pattern in filenames loads each of
+// the config files it names, see expandConfigFiles.
+func LoadConfigs(filenames []string, format string) (Config, error) {
+	var config Config
+	for _, name := range filenames {
+		expanded, err := expandConfigFiles(name)
+		if err != nil {
+			return config, err
+		}
+		for _, filename := range expanded {
+			c, err := loadConfig(filename, format)
+			if err != nil {
+				return config, err
+			}
+			config.merge(c)
+		}
+	}
+	return config, nil
+}
+
+// expandConfigFiles returns the files named by name in lexical order, so they
+// merge in a predictable order. A directory names the .json, .yaml, .yml and
+// .toml files directly within it, and a glob pattern that isn't itself a file
+// the files it matches. Any other name, stdin or a URL, is returned as is.
+func expandConfigFiles(name string) ([]string, error) {
+	if name == StdinFilename || isConfigURL(name) {
+		return []string{name}, nil
+	}
+
+	info, err := os.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, entry := range entries {
+			if !entry.IsDir() && isConfigExt(entry.Name()) {
+				files = append(files, filepath.Join(name, entry.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%v: directory has no .json, .yaml, .yml or .toml files", name)
+		}
+		return files, nil
+
+	case err != nil && strings.ContainsAny(name, "*?["):
+		files, err := filepath.Glob(name)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%v: pattern matches no files", name)
+		}
+		return files, nil
+	}
+	return []string{name}, nil
+}
+
+// merge applies other on top of c. A non-empty environment replaces c's.
+// Hosts are matched by name, new hosts are appended and for existing hosts the
+// non-empty fields of other replace those in c. Endpoints of matched hosts are
+// likewise matched by name, replacing those with the same name and appending
+// the rest.
+func (c *Config) merge(other Config) {
+	if other.Environment != "" {
+		c.Environment = other.Environment
+	}
+
+	for _, host := range other.Hosts {
+		existing := c.host(host.Name)
+		if existing == nil {
+			c.Hosts = append(c.Hosts, host)
+			continue
+		}
+		existing.merge(host)
+	}
+}
+
+// host returns the named host or nil if there isn't one.
+func (c *Config) host(name string) *Host {
+	for i := range c.Hosts {
+		if c.Hosts[i].Name == name {
+			return &c.Hosts[i]
+		}
+	}
+	return nil
+}
+
+// PinsHostKeys reports whether every host has a pinned host_key. Local hosts
+// have no key to verify.
+func (c *Config) PinsHostKeys() bool {
+	for _, host := range c.Hosts {
+		if host.HostKey == "" && !host.IsLocal() {
+			return false
+		}
+	}
+	return len(c.Hosts) > 0
+}
+
+// merge applies the non-empty fields and the endpoints of other on top of h.
+func (h *Host) merge(other Host) {
+	if other.Address != "" {
+		h.Address = other.Address
+	}
+	if other.Port != 0 {
+		h.Port = other.Port
+	}
+	if other.User != "" {
+		h.User = other.User
+	}
+	if other.Jump != "" {
+		h.Jump = other.Jump
+	}
+	if other.Socks != "" {
+		h.Socks = other.Socks
+	}
+	if other.MaxChannels != 0 {
+		h.MaxChannels = other.MaxChannels
+	}
+	if other.ConnectTimeout != 0 {
+		h.ConnectTimeout = other.ConnectTimeout
+	}
+	if other.KeepaliveInterval != 0 {
+		h.KeepaliveInterval = other.KeepaliveInterval
+	}
+	if other.KeepaliveMaxMissed != 0 {
+		h.KeepaliveMaxMissed = other.KeepaliveMaxMissed
+	}
+	if other.HostKey != "" {
+		h.HostKey = other.HostKey
+	}
+	if len(other.Ciphers) > 0 {
+		h.Ciphers = other.Ciphers
+	}
+	if len(other.MACs) > 0 {
+		h.MACs = other.MACs
+	}
+	if len(other.KeyExchanges) > 0 {
+		h.KeyExchanges = other.KeyExchanges
+	}
+	if other.Enabled != nil {
+		h.Enabled = other.Enabled
+	}
+
+	endpoints := append([]Endpoint(nil), h.Endpoints...)
+outer:
+	for _, endpoint := range other.Endpoints {
+		for i := range endpoints {
+			if endpoints[i].Name == endpoint.Name {
+				endpoints[i] = endpoint
+				continue outer
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	h.Endpoints = endpoints
+}
+
+// expandEnv replaces ${VAR} or $VAR in the addresses and user names with the
+// value of the environment variable.
+func (c *Config) expandEnv() {
+	for i := range c.Hosts {
+		host := &c.Hosts[i]
+		host.Address = os.ExpandEnv(host.Address)
+		host.User = os.ExpandEnv(host.User)
+		host.Jump = os.ExpandEnv(host.Jump)
+		host.Socks = os.ExpandEnv(host.Socks)
+		for j := range host.Endpoints {
+			endpoint := &host.Endpoints[j]
+			endpoint.LocalAddr = os.ExpandEnv(endpoint.LocalAddr)
+			endpoint.RemoteAddr = os.ExpandEnv(endpoint.RemoteAddr)
+			for k := range endpoint.LocalAddrs {
+				endpoint.LocalAddrs[k] = os.ExpandEnv(endpoint.LocalAddrs[k])
+			}
+			for k := range endpoint.RemoteAddrs {
+				endpoint.RemoteAddrs[k] = os.ExpandEnv(endpoint.RemoteAddrs[k])
+			}
+		}
+	}
+}
+
+// DefaultBind binds the listeners of local endpoints and SOCKS proxies whose
+// address has no host, such as :8080, to host rather than every interface.
+// Nothing is changed when host is empty.
+func (c *Config) DefaultBind(host string) {
+	if host == "" {
+		return
+	}
+
+	bind := func(addr string) string {
+		if strings.HasPrefix(addr, unixPrefix) {
+			return addr
+		}
+		h, port, err := net.SplitHostPort(addr)
+		if err != nil || h != "" {
+			return addr
+		}
+		return net.JoinHostPort(host, port)
+	}
+
+	for i := range c.Hosts {
+		h := &c.Hosts[i]
+		if h.Socks != "" {
+			h.Socks = bind(h.Socks)
+		}
+		for j := range h.Endpoints {
+			endpoint := &h.Endpoints[j]
+			if endpoint.Direction != DirectionRemote {
+				endpoint.LocalAddr = bind(endpoint.LocalAddr)
+				for k := range endpoint.LocalAddrs {
+					endpoint.LocalAddrs[k] = bind(endpoint.LocalAddrs[k])
+				}
+			}
+		}
+	}
+}
+
+// FilterTags disables the endpoints that have none of tags, and the hosts,
+// along with their SOCKS proxies, left without an enabled endpoint. Nothing
+// is changed when tags is empty.
+func (c *Config) FilterTags(tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	disabled := false
+	for i := range c.Hosts {
+		h := &c.Hosts[i]
+		matched := false
+		for j := range h.Endpoints {
+			endpoint := &h.Endpoints[j]
+			if !hasTag(endpoint.Tags, tags) {
+				endpoint.Enabled = &disabled
+			} else if endpoint.IsEnabled() {
+				matched = true
+			}
+		}
+		if !matched {
+			h.Enabled = &disabled
+		}
+	}
+}
+
+// hasTag reports whether any of tags is in have.
+func hasTag(have, tags []string) bool {
+	for _, tag := range tags {
+		if contains(have, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode writes the config to w as format, in the form it's loaded from.
+func (c Config) Encode(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+		return enc.Close()
+	case FormatTOML:
+		return toml.NewEncoder(w).Encode(c)
+	default:
+		return fmt.Errorf("unknown config format %q", format)
+	}
+}
+
+// formatFromExt returns the config format implied by the filename extension,
+// defaulting to JSON.
+func formatFromExt(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+// isConfigExt reports whether filename has one of the extensions formatFromExt
+// recognises.
+func isConfigExt(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+// ConfigError lists every problem found while validating a config.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// Validate checks that every host and endpoint is fully specified and that no
+// two endpoints bind the same address.
+func (c *Config) Validate() error {
+	var problems ConfigError
+	addf := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// bound tracks the endpoint bound to each local address, ports the first
+	// endpoint bound to each port and wildcards the endpoint bound to every
+	// interface on each port, which overlaps every other address with the port.
+	bound := make(map[string]string)
+	ports := make(map[string]string)
+	wildcards := make(map[string]string)
+	bind := func(network, addr, name string) {
+		host, port, _ := net.SplitHostPort(addr)
+		if strings.HasPrefix(addr, unixPrefix) {
+			host, port = "unix", addr
+		}
+		if port == "0" {
+			// the kernel picks a distinct port for each.
+			return
+		}
+		if host == "localhost" {
+			// listening on localhost binds its first address.
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+
+		// TCP and UDP ports don't overlap.
+		key, portKey := network+" "+addr, network+" "+port
+		if other, ok := bound[key]; ok {
+			addf("%v: local address %v is already used by %v", name, addr, other)
+			return
+		}
+		if other, ok := wildcards[portKey]; ok {
+			addf("%v: local address %v overlaps %v, which listens on every interface", name, addr, other)
+			return
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			if other, ok := ports[portKey]; ok {
+				addf("%v: local address %v listens on every interface, overlapping %v", name, addr, other)
+				return
+			}
+			wildcards[portKey] = name
+		}
+		bound[key] = name
+		if _, ok := ports[portKey]; !ok {
+			ports[portKey] = name
+		}
+	}
+
+	if len(c.Hosts) == 0 {
+		addf("config has no hosts, add at least one to \"hosts\"")
+	}
+
+	names := make(map[string]bool, len(c.Hosts))
+	locals := make(map[string]bool)
+	// stdio is the enabled endpoint forwarding stdin and stdout, if any.
+	var stdio string
+	for _, host := range c.Hosts {
+		if names[host.Name] && host.Name != "" {
+			addf("%v: name is already used by another host", host.Name)
+		}
+		names[host.Name] = true
+		if host.IsLocal() {
+			locals[host.Name] = true
+		}
+	}
+
+	for i, host := range c.Hosts {
+		hostName := host.Name
+		if hostName == "" {
+			hostName = fmt.Sprintf("hosts[%d]", i)
+			addf("%v: name is required", hostName)
+		}
+
+		if host.IsLocal() {
+			if host.Port != 0 {
+				addf("%v: local hosts can't have a port", hostName)
+			}
+			if host.Jump != "" {
+				addf("%v: local hosts can't have a jump", hostName)
+			}
+		} else if err := validateAddr(host.HostPort()); err != nil {
+			addf("%v: address %v", hostName, err)
+		}
+		if locals[host.Jump] {
+			addf("%v: jump %v is a local host", hostName, host.Jump)
+		}
+		if host.Port < 0 || host.Port > 65535 {
+			addf("%v: port %d is invalid", hostName, host.Port)
+		} else if _, port, err := net.SplitHostPort(host.Address); err == nil && host.Port != 0 && port != strconv.Itoa(host.Port) {
+			addf("%v: port %d conflicts with address %v", hostName, host.Port, host.Address)
+		}
+
+		if host.Jump != "" && !names[host.Jump] {
+			for _, jump := range strings.Split(host.Jump, ",") {
+				// strip the user of a user@host jump.
+				jump = jump[strings.LastIndex(jump, "@")+1:]
+				if err := validateAddr(withPort(jump, 0)); err != nil {
+					addf("%v: jump must be a host name or address, %v", hostName, err)
+				}
+			}
+		}
+
+		if host.HostKey != "" {
+			if _, err := parseHostKey(host.HostKey); err != nil {
+				addf("%v: %v", hostName, err)
+			}
+		}
+
+		if err := validateAlgorithms("cipher", host.Ciphers, supportedCiphers); err != nil {
+			addf("%v: %v", hostName, err)
+		}
+		if err := validateAlgorithms("mac", host.MACs, supportedMACs); err != nil {
+			addf("%v: %v", hostName, err)
+		}
+		if err := validateAlgorithms("key exchange", host.KeyExchanges, supportedKeyExchanges); err != nil {
+			addf("%v: %v", hostName, err)
+		}
+
+		if host.MaxChannels < 0 {
+			addf("%v: max_channels must not be negative", hostName)
+		}
+		if host.ConnectTimeout < 0 {
+			addf("%v: connect_timeout must not be negative", hostName)
+		}
+		if host.KeepaliveInterval < 0 {
+			addf("%v: keepalive_interval must not be negative", hostName)
+		}
+		// zero leaves -keepalive-max-missed in effect.
+		if host.KeepaliveMaxMissed < 0 {
+			addf("%v: keepalive_max_missed must be at least 1", hostName)
+		}
+
+		if host.Socks != "" {
+			if err := validateAddr(host.Socks); err != nil {
+				addf("%v: socks %v", hostName, err)
+			} else if host.IsEnabled() {
+				bind(ProtocolTCP, normaliseAddr(host.Socks), hostName+" socks")
+			}
+		}
+
+		// remoteBound tracks the endpoint bound to each address on this host.
+		remoteBound := make(map[string]string)
+		endpointNames := make(map[string]bool, len(host.Endpoints))
+
+		for j, endpoint := range host.Endpoints {
+			name := hostName + "/" + endpoint.Name
+			if endpoint.Name == "" {
+				name = fmt.Sprintf("%v/endpoints[%d]", hostName, j)
+				addf("%v: name is required", name)
+			} else if endpointNames[endpoint.Name] {
+				addf("%v: name is already used by another endpoint", name)
+			}
+			endpointNames[endpoint.Name] = true
+
+			var localErr error
+			if !endpoint.IsStdio() {
+				localErr = validateEndpointAddr(endpoint.LocalAddr)
+			}
+			if localErr != nil {
+				addf("%v: local %v", name, localErr)
+			}
+			template := isRemoteTemplate(endpoint.RemoteAddr)
+			var remoteErr error
+			if template {
+				remoteErr = validateRemoteTemplate(endpoint.RemoteAddr)
+			} else {
+				remoteErr = validateEndpointAddr(endpoint.RemoteAddr)
+			}
+			if remoteErr != nil {
+				addf("%v: remote %v", name, remoteErr)
+			}
+			if template {
+				if endpoint.Direction == DirectionRemote || endpoint.Protocol == ProtocolUDP {
+					addf("%v: remote templates need a local tcp endpoint", name)
+				}
+				if endpoint.Probe && strings.Contains(endpoint.RemoteAddr, "{client_host}") {
+					addf("%v: probe can't be used with {client_host}", name)
+				}
+			}
+			// a template is expanded for each connection rather than paired
+			// with the local ports.
+			paired := remoteErr == nil && !template
+
+			// expanding can't fail once the addresses are valid.
+			localAddrs, _ := expandPortRange(endpoint.LocalAddr)
+			remoteAddrs, _ := expandPortRange(endpoint.RemoteAddr)
+			if localErr == nil && paired && len(localAddrs) != len(remoteAddrs) {
+				addf("%v: local and remote port ranges must be the same length", name)
+			}
+
+			for _, addr := range endpoint.LocalAddrs {
+				if err := validateEndpointAddr(addr); err != nil {
+					addf("%v: local_addrs %v", name, err)
+					localErr = err
+					continue
+				}
+				addrs, _ := expandPortRange(addr)
+				if paired && len(addrs) != len(remoteAddrs) {
+					addf("%v: local_addrs and remote port ranges must be the same length", name)
+				}
+				localAddrs = append(localAddrs, addrs...)
+			}
+			if len(endpoint.LocalAddrs) > 0 && endpoint.Direction == DirectionRemote {
+				addf("%v: local_addrs requires the local direction", name)
+			}
+
+			for _, addr := range endpoint.RemoteAddrs {
+				if err := validateEndpointAddr(addr); err != nil {
+					addf("%v: remote_addrs %v", name, err)
+				}
+			}
+			if len(endpoint.RemoteAddrs) > 0 {
+				if endpoint.Direction == DirectionRemote || endpoint.Protocol == ProtocolUDP {
+					addf("%v: remote_addrs requires a local tcp endpoint", name)
+				}
+				if template || (remoteErr == nil && len(remoteAddrs) > 1) {
+					addf("%v: remote_addrs can't be used with a remote port range or template", name)
+				}
+				for _, addr := range endpoint.RemoteAddrs {
+					if addrs, _ := expandPortRange(addr); len(addrs) > 1 || isRemoteTemplate(addr) {
+						addf("%v: remote_addrs can't be port ranges or templates", name)
+						break
+					}
+				}
+			}
+
+			if endpoint.IsStdio() {
+				if endpoint.Direction == DirectionRemote || endpoint.Protocol == ProtocolUDP {
+					addf("%v: stdio endpoints must be local tcp endpoints", name)
+				}
+				if len(endpoint.LocalAddrs) > 0 || len(endpoint.RemoteAddrs) > 0 || template {
+					addf("%v: stdio endpoints can't use local_addrs, remote_addrs or remote templates", name)
+				}
+				if host.IsEnabled() && endpoint.IsEnabled() {
+					if stdio != "" {
+						addf("%v: stdio is already forwarded by %v", name, stdio)
+					}
+					stdio = name
+				}
+			}
+
+			if endpoint.MaxConns < 0 {
+				addf("%v: max_conns must not be negative", name)
+			}
+			if endpoint.RateLimit < 0 {
+				addf("%v: rate_limit must not be negative", name)
+			}
+			if endpoint.DialRetries < 0 {
+				addf("%v: dial_retries must not be negative", name)
+			}
+			if endpoint.IdleTimeout < 0 {
+				addf("%v: idle_timeout must not be negative", name)
+			}
+			if endpoint.TCPKeepAlive < 0 {
+				addf("%v: tcp_keepalive must not be negative", name)
+			}
+			if endpoint.WarmConns < 0 {
+				addf("%v: warm_conns must not be negative", name)
+			}
+			if endpoint.WarmConns > 0 {
+				target := endpoint.RemoteAddr
+				if endpoint.Direction == DirectionRemote {
+					target = endpoint.LocalAddr
+				}
+				if targets, _ := expandPortRange(target); endpoint.Protocol == ProtocolUDP || endpoint.IsStdio() ||
+					template || len(endpoint.RemoteAddrs) > 0 || len(targets) > 1 {
+					addf("%v: warm_conns needs a tcp endpoint with a single target, not udp, stdio, remote_addrs, a remote template or a port range", name)
+				}
+			}
+			switch endpoint.ProxyProtocol {
+			case "", ProxyProtocolV1, ProxyProtocolV2:
+			default:
+				addf("%v: proxy_protocol must be %q or %q, got %q", name, ProxyProtocolV1, ProxyProtocolV2, endpoint.ProxyProtocol)
+			}
+			if endpoint.ProxyProtocol != "" && (endpoint.Protocol == ProtocolUDP || endpoint.IsStdio()) {
+				addf("%v: proxy_protocol needs a tcp endpoint, not udp or stdio", name)
+			}
+			if _, err := parseAllowList(endpoint.Allow); err != nil {
+				addf("%v: %v", name, err)
+			}
+			if len(endpoint.Allow) > 0 {
+				listenAddr := endpoint.LocalAddr
+				if endpoint.Direction == DirectionRemote {
+					listenAddr = endpoint.RemoteAddr
+				}
+				if endpoint.IsStdio() || strings.HasPrefix(listenAddr, unixPrefix) {
+					addf("%v: allow needs a TCP or UDP listener, not stdio or a unix socket", name)
+				}
+			}
+
+			protocol := endpoint.Protocol
+			switch protocol {
+			case "":
+				protocol = ProtocolTCP
+			case ProtocolTCP:
+			case ProtocolUDP:
+				if endpoint.Direction == DirectionRemote {
+					addf("%v: udp endpoints must have the local direction", name)
+				}
+				if strings.HasPrefix(endpoint.LocalAddr, unixPrefix) || strings.HasPrefix(endpoint.RemoteAddr, unixPrefix) {
+					addf("%v: udp endpoints can't use unix sockets", name)
+				}
+				if len(endpoint.LocalAddrs) > 0 {
+					addf("%v: udp endpoints can't use local_addrs", name)
+				} else if len(localAddrs) > 1 {
+					addf("%v: udp endpoints can't use port ranges", name)
+				}
+				if endpoint.RateLimit != 0 {
+					addf("%v: rate_limit isn't supported by udp endpoints", name)
+				}
+			default:
+				addf("%v: protocol must be %q or %q, got %q", name, ProtocolTCP, ProtocolUDP, endpoint.Protocol)
+			}
+
+			// disabled endpoints don't bind anything.
+			enabled := host.IsEnabled() && endpoint.IsEnabled()
+			switch endpoint.Direction {
+			case "", DirectionLocal:
+				if localErr != nil || !enabled || endpoint.IsStdio() {
+					break
+				}
+				for _, addr := range localAddrs {
+					bind(protocol, normaliseAddr(addr), name)
+				}
+			case DirectionRemote:
+				if host.IsLocal() {
+					addf("%v: local hosts can't have remote endpoints", name)
+				}
+				if remoteErr != nil || !enabled {
+					break
+				}
+				for _, addr := range remoteAddrs {
+					addr = normaliseAddr(addr)
+					if other, ok := remoteBound[addr]; ok {
+						addf("%v: remote address %v is already used by %v", name, addr, other)
+					} else {
+						remoteBound[addr] = name
+					}
+				}
+			default:
+				addf("%v: direction must be %q or %q, got %q", name, DirectionLocal, DirectionRemote, endpoint.Direction)
+			}
+		}
+	}
+
+	for _, cycle := range c.jumpCycles() {
+		addf("%v: jump hosts form a cycle", cycle)
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// findEndpoint returns the endpoint named host/endpoint, or the only endpoint
+// named name, and its host.
+func (c *Config) findEndpoint(name string) (Host, Endpoint, error) {
+	hostName, endpointName, qualified := strings.Cut(name, "/")
+	if !qualified {
+		hostName, endpointName = "", name
+	}
+
+	var found []string
+	var host Host
+	var endpoint Endpoint
+	for _, h := range c.Hosts {
+		if qualified && h.Name != hostName {
+			continue
+		}
+		for _, e := range h.Endpoints {
+			if e.Name == endpointName {
+				host, endpoint = h, e
+				found = append(found, h.Name+"/"+e.Name)
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return host, endpoint, fmt.Errorf("no endpoint named %v", name)
+	case 1:
+		return host, endpoint, nil
+	default:
+		return host, endpoint, fmt.Errorf("endpoint %v is ambiguous, use one of %v", name, strings.Join(found, ", "))
+	}
+}
+
+// enabledHosts returns the enabled hosts, without their disabled endpoints.
+// Each host or endpoint skipped is logged.
+func (c *Config) enabledHosts() []Host {
+	var hosts []Host
+	for _, host := range c.Hosts {
+		if !host.IsEnabled() {
+			slog.Info("Host disabled, skipping", "host", host.Name)
+			continue
+		}
+
+		endpoints := make([]Endpoint, 0, len(host.Endpoints))
+		for _, endpoint := range host.Endpoints {
+			if !endpoint.IsEnabled() {
+				slog.Info("Endpoint disabled, skipping", "host", host.Name, "endpoint", endpoint.Name)
+				continue
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		host.Endpoints = endpoints
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// IsEnabled reports whether the host is enabled, as it is unless Enabled is false.
+func (h Host) IsEnabled() bool {
+	return h.Enabled == nil || *h.Enabled
+}
+
+// IsEnabled reports whether the endpoint is enabled, as it is unless Enabled is false.
+func (e Endpoint) IsEnabled() bool {
+	return e.Enabled == nil || *e.Enabled
+}
+
+// IsStdio reports whether the endpoint forwards stdin and stdout, see StdioAddr.
+func (e Endpoint) IsStdio() bool {
+	return e.LocalAddr == StdioAddr
+}
+
+// UsesStdio reports whether an enabled endpoint of an enabled host forwards
+// stdin and stdout.
+func (c *Config) UsesStdio() bool {
+	for _, host := range c.enabledHosts() {
+		for _, endpoint := range host.Endpoints {
+			if endpoint.IsEnabled() && endpoint.IsStdio() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Listeners returns the number of local addresses the enabled endpoints and
+// SOCKS proxies listen on, each needing a file descriptor. Remote endpoints
+// listen on their host and aren't counted.
+func (c *Config) Listeners() int {
+	n := 0
+	for _, host := range c.Hosts {
+		if !host.IsEnabled() {
+			continue
+		}
+		if host.Socks != "" {
+			n++
+		}
+		for _, endpoint := range host.Endpoints {
+			if !endpoint.IsEnabled() || endpoint.IsStdio() || endpoint.Direction == DirectionRemote {
+				continue
+			}
+			for _, spec := range endpoint.localAddrs() {
+				addrs, _ := expandPortRange(spec)
+				n += len(addrs)
+			}
+		}
+	}
+	return n
+}
+
+// localAddrs returns LocalAddr followed by LocalAddrs.
+func (e Endpoint) localAddrs() []string {
+	return append([]string{e.LocalAddr}, e.LocalAddrs...)
+}
+
+// remoteAddrs returns RemoteAddr followed by RemoteAddrs.
+func (e Endpoint) remoteAddrs() []string {
+	return append([]string{e.RemoteAddr}, e.RemoteAddrs...)
+}
+
+// jumpCycles returns the names of hosts whose jump chain loops back on itself.
+func (c *Config) jumpCycles() []string {
+	jumps := make(map[string]string, len(c.Hosts))
+	for _, host := range c.Hosts {
+		jumps[host.Name] = host.Jump
+	}
+
+	var cycles []string
+	for _, host := range c.Hosts {
+		seen := map[string]bool{host.Name: true}
+		for name := host.Jump; name != ""; name = jumps[name] {
+			if seen[name] {
+				cycles = append(cycles, host.Name)
+				break
+			}
+			seen[name] = true
+		}
+	}
+	return cycles
+}
+
+// HostPort returns the host:port to dial for h, or LocalHost for a local host.
+func (h Host) HostPort() string {
+	if h.IsLocal() {
+		return LocalHost
+	}
+	return withPort(h.Address, h.Port)
+}
+
+// IsLocal reports whether h is a local host, whose endpoints aren't forwarded
+// over ssh.
+func (h Host) IsLocal() bool {
+	return h.Address == LocalHost
+}
+
+// withPort returns addr unchanged if it has a port, otherwise it's joined with
+// port or, when port is zero, the default ssh port.
+func withPort(addr string, port int) string {
+	if addr == "" {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// validateAddr checks addr is a host:port pair with a numeric port.
+func validateAddr(addr string) error {
+	if addr == "" {
+		return errors.New("is required")
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("%q is invalid: IPv6 addresses must be bracketed, e.g. [::1]:22", addr)
+		}
+		return fmt.Errorf("%q is invalid: %v", addr, err)
+	}
+
+	// ssh only carries numeric ports, service names aren't looked up.
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("%q has an invalid port, it must be a number", addr)
+	}
+
+	return nil
+}
+
+// validateEndpointAddr checks addr is either a host:port pair, a host and port
+// range or a Unix domain socket path.
+func validateEndpointAddr(addr string) error {
+	if network, path := splitNetwork(addr); network == "unix" {
+		if path == "" {
+			return fmt.Errorf("%q has no socket path", addr)
+		}
+		return nil
+	}
+
+	addrs, err := expandPortRange(addr)
+	if err != nil {
+		return err
+	}
+	if len(addrs) > 1 {
+		// the ports of a range are already known to be valid.
+		return nil
+	}
+	return validateAddr(addr)
+}
+
+// expandPortRange returns an address for each port of a range such as
+// localhost:9000-9010. Other addresses are returned unchanged.
+func expandPortRange(addr string) ([]string, error) {
+	if network, _ := splitNetwork(addr); network == "unix" {
+		return []string{addr}, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !strings.Contains(port, "-") {
+		return []string{addr}, nil
+	}
+
+	bounds := strings.SplitN(port, "-", 2)
+	first, err1 := strconv.Atoi(bounds[0])
+	last, err2 := strconv.Atoi(bounds[1])
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("%q has an invalid port range", addr)
+	}
+
+	addrs := make([]string, 0, last-first+1)
+	for p := first; p <= last; p++ {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return addrs, nil
+}
+
+// splitNetwork returns the network and address to use for an endpoint address.
+func splitNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+// normaliseAddr returns addr in a canonical form for comparison, so different
+// spellings of the same IP address, such as [::1] and [0:0::1], compare equal.
+func normaliseAddr(addr string) string {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return unixPrefix + filepath.Clean(strings.TrimPrefix(addr, unixPrefix))
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
@@ -0,0 +1,70 @@
+package sshforward
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateEndpointAddrIPv6(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{"[::1]:8080", true},
+		{"[2001:db8::10]:22", true},
+		{"[fe80::1%eth0]:22", true},
+		{"[::1]:9000-9002", true},
+		{"[::]:0", true},
+		{"::1:8080", false},
+		{"[::1]", false},
+		{"[::1]:http", false},
+	}
+	for _, tt := range tests {
+		err := validateEndpointAddr(tt.addr)
+		if got := err == nil; got != tt.valid {
+			t.Errorf("validateEndpointAddr(%q) = %v, want valid %v", tt.addr, err, tt.valid)
+		}
+	}
+}
+
+func TestExpandPortRangeIPv6(t *testing.T) {
+	got, err := expandPortRange("[::1]:9000-9002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"[::1]:9000", "[::1]:9001", "[::1]:9002"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandPortRange() = %q, want %q", got, want)
+	}
+}
+
+func TestNormaliseAddrIPv6(t *testing.T) {
+	for _, addr := range []string{"[::1]:80", "[0:0::1]:80", "[0000::0001]:80"} {
+		if got := normaliseAddr(addr); got != "[::1]:80" {
+			t.Errorf("normaliseAddr(%q) = %q, want [::1]:80", addr, got)
+		}
+	}
+}
+
+func TestValidateKeepaliveMaxMissed(t *testing.T) {
+	tests := []struct {
+		maxMissed int
+		valid     bool
+	}{
+		// zero leaves -keepalive-max-missed in effect.
+		{0, true},
+		{1, true},
+		{5, true},
+		{-1, false},
+	}
+	for _, tt := range tests {
+		config := Config{
+			Environment: "test",
+			Hosts:       []Host{{Name: "host", Address: "127.0.0.1:22", KeepaliveMaxMissed: tt.maxMissed}},
+		}
+		err := config.Validate()
+		if got := err == nil; got != tt.valid {
+			t.Errorf("Validate() with keepalive_max_missed %v = %v, want valid %v", tt.maxMissed, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package sshforward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ConfigHeader is added to the requests for configs loaded from http:// and
+// https:// URLs, e.g. an Authorization header. It must be set before any
+// configs are loaded.
+var ConfigHeader = http.Header{}
+
+// ConfigInsecureSkipVerify skips verifying the certificate of https:// config
+// URLs. (not recommended)
+var ConfigInsecureSkipVerify bool
+
+// configFetchTimeout bounds fetching a config from a URL.
+const configFetchTimeout = 30 * time.Second
+
+// isConfigURL reports whether filename is an http:// or https:// URL rather than
+// a file.
+func isConfigURL(filename string) bool {
+	return strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://")
+}
+
+// configURLPath returns the path of the config URL raw, used to pick its format.
+func configURLPath(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return path.Base(u.Path)
+}
+
+// fetchConfig returns the body of a GET of the config URL raw. The caller must
+// close it.
+func fetchConfig(raw string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range ConfigHeader {
+		req.Header[name] = values
+	}
+
+	client := &http.Client{Timeout: configFetchTimeout}
+	if ConfigInsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client.Transport = transport
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v: %v", raw, resp.Status)
+	}
+	return resp.Body, nil
+}
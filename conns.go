@@ -0,0 +1,69 @@
+package sshforward
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// connGroup tracks in-flight forwarded connections. Unlike the listeners, they
+// outlive the forwarder's context so they're given the grace period to
+// complete once it's closed; its context is done once they must close.
+//
+// Each endpoint has its own group so it can be drained when it's stopped by a
+// reload. Its connections are also counted by the parent, the host's group,
+// which is drained on shutdown and whose close interrupts the endpoints' too.
+type connGroup struct {
+	wg     sync.WaitGroup
+	parent *connGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newConnGroup returns a group within parent, which may be nil.
+func newConnGroup(parent *connGroup) *connGroup {
+	ctx := context.Background()
+	if parent != nil {
+		ctx = parent.ctx
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &connGroup{parent: parent, ctx: ctx, cancel: cancel}
+}
+
+// add records a new connection, which must call done once it completes.
+func (g *connGroup) add() {
+	g.wg.Add(1)
+	if g.parent != nil {
+		g.parent.add()
+	}
+}
+
+// done records a connection has completed.
+func (g *connGroup) done() {
+	if g.parent != nil {
+		g.parent.done()
+	}
+	g.wg.Done()
+}
+
+// drain waits up to grace for the in-flight connections to complete and
+// reports whether they did.
+func (g *connGroup) drain(grace time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// close interrupts the in-flight connections.
+func (g *connGroup) close() {
+	g.cancel()
+}
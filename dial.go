@@ -0,0 +1,230 @@
+package sshforward
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hop is a single ssh connection on the route to a host.
+type hop struct {
+	Name    string
+	Address string
+	Config  *ssh.ClientConfig
+	// HostKey is the host's pinned host_key, if any.
+	HostKey string
+	// Proxy is the HTTP proxy the hop is dialled through, nil dials it
+	// directly. Only the first hop is dialled through the proxy.
+	Proxy *url.URL
+}
+
+// maxHops bounds the length of a route, guarding against ssh_config jump
+// cycles that can't be detected when the config is validated.
+const maxHops = 16
+
+// route returns the hops required to reach host, following its jump hosts.
+// Jumps that name another host in hosts use that host's settings, otherwise the
+// jump is parsed as a jump spec, see parseJump, and dialled with base. Each
+// host is resolved against the ssh_config in opts and falls back to its
+// password auth methods.
+func route(hosts []Host, host Host, base ssh.ClientConfig, opts Options) []hop {
+	if host.IsLocal() {
+		// a local host isn't dialled.
+		return []hop{{Name: host.Name, Address: LocalHost, Config: &ssh.ClientConfig{}}}
+	}
+
+	byName := make(map[string]Host, len(hosts))
+	for _, h := range hosts {
+		byName[h.Name] = h
+	}
+
+	var hops []hop
+	for len(hops) < maxHops {
+		host = opts.SSHConfig.resolve(host)
+		h := hop{Name: host.Name, Address: host.HostPort(), Config: hostConfig(base, host, opts), HostKey: host.HostKey}
+		hops = append([]hop{h}, hops...)
+		if host.Jump == "" {
+			break
+		}
+
+		jump, ok := byName[host.Jump]
+		if !ok {
+			jump = parseJump(host.Jump)
+		}
+		host = jump
+	}
+	hops[0].Proxy = opts.Proxy
+	return hops
+}
+
+// parseJump returns the host for a jump spec in the form of ssh -J, a comma
+// separated list of [user@]host[:port] hops. The host is the last hop, reached
+// through the hops before it.
+func parseJump(spec string) Host {
+	jumps := strings.Split(spec, ",")
+	last := jumps[len(jumps)-1]
+
+	host := Host{Name: last, Jump: strings.Join(jumps[:len(jumps)-1], ",")}
+	if i := strings.LastIndex(last, "@"); i >= 0 {
+		host.User, last = last[:i], last[i+1:]
+	}
+	host.Address = last
+	return host
+}
+
+// hostConfig returns a copy of base with the host specific settings applied.
+// The host's accepted key and, unless opts.HideBanners is set or base has its
+// own BannerCallback, any banner it sends are logged.
+func hostConfig(base ssh.ClientConfig, host Host, opts Options) *ssh.ClientConfig {
+	logger := slog.With("host", host.Name)
+	if host.User != "" {
+		base.User = host.User
+	}
+	if host.ConnectTimeout > 0 {
+		base.Timeout = time.Duration(host.ConnectTimeout) * time.Second
+	}
+	if host.HostKey != "" {
+		base.HostKeyCallback = pinnedHostKey(host.HostKey)
+	}
+	if len(host.Ciphers) > 0 {
+		base.Ciphers = host.Ciphers
+	}
+	if len(host.MACs) > 0 {
+		base.MACs = host.MACs
+	}
+	if len(host.KeyExchanges) > 0 {
+		base.KeyExchanges = host.KeyExchanges
+	}
+	if methods := opts.Passwords.methods(base.User, host.HostPort()); methods != nil {
+		base.Auth = append(append([]ssh.AuthMethod(nil), base.Auth...), methods...)
+	}
+
+	// a nil callback is left for the ssh package to reject.
+	if verify := base.HostKeyCallback; verify != nil {
+		base.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := verify(hostname, remote, key); err != nil {
+				return err
+			}
+			logger.Info("Host key accepted", "type", key.Type(), "fingerprint", ssh.FingerprintSHA256(key))
+			return nil
+		}
+	}
+
+	if base.BannerCallback == nil && !opts.HideBanners {
+		base.BannerCallback = func(message string) error {
+			logger.Info("Banner", "banner", strings.TrimSpace(message))
+			return nil
+		}
+	}
+	return &base
+}
+
+// dialRoute connects to each hop in turn through the previous one and returns
+// the client for the last hop. Closing the returned client closes the
+// intermediate hops. Each hop's Config.Timeout bounds both establishing the
+// connection and the ssh handshake.
+func dialRoute(hops []hop) (*ssh.Client, error) {
+	first := hops[0]
+	var conn net.Conn
+	var err error
+	if first.Proxy != nil {
+		conn, err = dialProxy(first.Proxy, first.Address, first.Config.Timeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", first.Address, first.Config.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(conn, first)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range hops[1:] {
+		next, err := dialThrough(client, h)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("jump to %v <%v>: %v", h.Name, h.Address, err)
+		}
+
+		// close the jump host once the connection through it ends.
+		go func(jump *ssh.Client) {
+			next.Wait()
+			jump.Close()
+		}(client)
+
+		client = next
+	}
+
+	return client, nil
+}
+
+// dialThrough establishes an ssh connection to h tunnelled through jump.
+func dialThrough(jump *ssh.Client, h hop) (*ssh.Client, error) {
+	conn, err := dialTimeout(jump.Dial, h.Address, h.Config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(conn, h)
+}
+
+// newClient performs the ssh handshake for h over conn, closing conn if it
+// fails or doesn't complete within h.Config.Timeout.
+func newClient(conn net.Conn, h hop) (*ssh.Client, error) {
+	var timer *time.Timer
+	if h.Config.Timeout > 0 {
+		// not every conn supports deadlines, closing it interrupts the handshake.
+		timer = time.AfterFunc(h.Config.Timeout, func() {
+			conn.Close()
+		})
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, h.Address, h.Config)
+	if timer != nil && !timer.Stop() {
+		err = fmt.Errorf("ssh handshake timed out after %v", h.Config.Timeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialTimeout calls dial, abandoning it with an error if it hasn't completed
+// within timeout. A zero timeout waits indefinitely.
+func dialTimeout(dial func(network, addr string) (net.Conn, error), addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial("tcp", addr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial("tcp", addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// close the connection should the dial complete after all.
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %v: timed out after %v", addr, timeout)
+	}
+}
@@ -0,0 +1,102 @@
+package sshforward
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// eventLogQueue bounds the events waiting to be written, further events are
+// dropped.
+const eventLogQueue = 1024
+
+// EventLog writes lifecycle events to a stream as newline delimited JSON, one
+// WebhookEvent per line. Events are queued without blocking and dropped while
+// the queue is full, so a slow reader never holds up forwarding.
+type EventLog struct {
+	enc    *json.Encoder
+	failed bool
+	events chan WebhookEvent
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewEventLog returns an event log writing to w.
+func NewEventLog(w io.Writer) *EventLog {
+	l := &EventLog{
+		enc:    json.NewEncoder(w),
+		events: make(chan WebhookEvent, eventLogQueue),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Close writes any queued events and stops the event log. It doesn't close
+// the stream.
+func (l *EventLog) Close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+}
+
+// send queues an event, doing nothing if l is nil.
+func (l *EventLog) send(e WebhookEvent) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+	}
+}
+
+// run writes the queued events until stopped.
+func (l *EventLog) run() {
+	defer close(l.done)
+
+	for {
+		select {
+		case e := <-l.events:
+			l.write(e)
+		case <-l.stop:
+			for {
+				select {
+				case e := <-l.events:
+					l.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a single event, logging only the first failure so a closed
+// stream doesn't flood the log.
+func (l *EventLog) write(e WebhookEvent) {
+	if err := l.enc.Encode(e); err != nil && !l.failed {
+		l.failed = true
+		slog.Warn("Failed to write event", "error", err)
+	}
+}
+
+// eventSinks are sent lifecycle events, either may be nil.
+type eventSinks struct {
+	webhook *Webhook
+	log     *EventLog
+}
+
+// send stamps e with the current time and sends it to each sink.
+func (s eventSinks) send(e WebhookEvent) {
+	if s.webhook == nil && s.log == nil {
+		return
+	}
+	e.Time = time.Now()
+	s.webhook.send(e)
+	s.log.send(e)
+}
@@ -0,0 +1,575 @@
+package sshforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// forwardEndpoint adds port forwarding from a remote service to locally bound
+// addresses, or from a local service to a remotely bound address, until ctx is
+// done or the connection is lost. Each accepted connection is tracked in conns,
+// running until it completes or conns is closed, and the listener state and
+// connection count are recorded in stats. Connections beyond the endpoint's
+// MaxConns, or the MaxConns of opts, are rejected, as are connections while brk is
+// open. A templated RemoteAddr is expanded for each connection, see
+// expandRemote, and connections to an endpoint with RemoteAddrs are spread
+// across its targets, see targetPool.
+func forwardEndpoint(ctx context.Context, logger *slog.Logger, client *channelClient, endpoint Endpoint, conns *connGroup, stats *endpointStats, opts *Options, brk *breaker) error {
+	listen := func(network, addr string) (net.Listener, error) {
+		return listenLocal(network, addr, opts.BindRetries, opts.ListenBacklog)
+	}
+	listenSpecs := endpoint.localAddrs()
+	direction := endpoint.Direction
+	dial := func(network, addr string) (net.Conn, error) {
+		return client.dial(ctx, network, addr)
+	}
+	dialAddr := endpoint.RemoteAddr
+
+	if endpoint.Protocol == ProtocolUDP {
+		return forwardUDP(ctx, logger, client, endpoint, conns, stats, opts, brk)
+	}
+
+	switch endpoint.Direction {
+	case "":
+		direction = DirectionLocal
+	case DirectionLocal:
+	case DirectionRemote:
+		listen, listenSpecs = client.listen, []string{endpoint.RemoteAddr}
+		dial = func(network, addr string) (net.Conn, error) {
+			return dialTarget(ctx, nil, network, addr, opts.TargetDialTimeout)
+		}
+		dialAddr = endpoint.LocalAddr
+	default:
+		return fmt.Errorf("unknown direction %q", endpoint.Direction)
+	}
+
+	allow, err := parseAllowList(endpoint.Allow)
+	if err != nil {
+		return err
+	}
+	limit := newLimiter(endpoint.MaxConns)
+	// each direction is throttled separately.
+	forwardThrottle := newThrottle(endpoint.RateLimit)
+	remoteThrottle := newThrottle(endpoint.RateLimit)
+	idleTimeout := time.Duration(endpoint.IdleTimeout) * time.Second
+	clientKeepAlive := opts.TCPKeepAlive
+	if endpoint.TCPKeepAlive > 0 {
+		clientKeepAlive = time.Duration(endpoint.TCPKeepAlive) * time.Second
+	}
+
+	template := direction == DirectionLocal && isRemoteTemplate(dialAddr)
+	var pool *targetPool
+	if direction == DirectionLocal {
+		pool = newTargetPool(endpoint.remoteAddrs())
+	}
+	dialAddrs, err := expandPortRange(dialAddr)
+	if err != nil {
+		return err
+	}
+	// each listen address is paired with the target at the same index.
+	var listenAddrs, targets []string
+	for _, spec := range listenSpecs {
+		addrs, err := expandPortRange(spec)
+		if err != nil {
+			return err
+		}
+		listenAddrs = append(listenAddrs, addrs...)
+		if template {
+			// every listener shares the template.
+			for range addrs {
+				targets = append(targets, dialAddr)
+			}
+			continue
+		}
+		if len(addrs) != len(dialAddrs) {
+			return fmt.Errorf("port ranges of %v and %v differ in length", spec, dialAddr)
+		}
+		targets = append(targets, dialAddrs...)
+	}
+
+	if endpoint.Probe && pool != nil {
+		// any one target will do.
+		var errs []string
+		for _, addr := range pool.addrs {
+			conn, err := dial(splitNetwork(addr))
+			if err == nil {
+				conn.Close()
+				errs = nil
+				break
+			}
+			errs = append(errs, fmt.Sprintf("%v: %v", addr, err))
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("probe of every target failed, %v", strings.Join(errs, ", "))
+		}
+	} else if endpoint.Probe {
+		probed := make(map[string]bool, len(targets))
+		for i, addr := range targets {
+			if template {
+				// the client isn't known until a connection is accepted, so
+				// Validate rejects probes of such templates.
+				if strings.Contains(addr, "{client_host}") {
+					continue
+				}
+				addr = expandRemote(addr, listenAddrs[i], "")
+			}
+			if probed[addr] {
+				continue
+			}
+			probed[addr] = true
+			conn, err := dial(splitNetwork(addr))
+			if err != nil {
+				return fmt.Errorf("probe of %v failed: %v", addr, err)
+			}
+			conn.Close()
+		}
+	}
+
+	from := dialAddr
+	if pool != nil {
+		from = strings.Join(pool.addrs, ",")
+	}
+	logger.Info("Forwarding", "from", from, "to", strings.Join(listenSpecs, ","), "direction", direction)
+
+	listeners := make([]net.Listener, 0, len(listenAddrs))
+	for _, addr := range listenAddrs {
+		l, err := listen(splitNetwork(addr))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("forwarding port bind error: %v", err)
+		}
+		if _, port, _ := net.SplitHostPort(addr); port == "0" {
+			logger.Info("Listening on an assigned port", "address", l.Addr().String())
+		}
+		listeners = append(listeners, l)
+	}
+	bound := make([]string, len(listeners))
+	for i, l := range listeners {
+		bound[i] = l.Addr().String()
+	}
+	stats.setAddrs(bound)
+	stats.setListening(true)
+	defer stats.setListening(false)
+
+	// a failing listener stops the rest.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the warm connections are dialled once listening and closed with the
+	// listeners. warm_conns is only valid with a single target.
+	warm := newWarmPool(ctx, logger, endpoint.WarmConns, dial, dialAddr, opts.tuneTCP)
+
+	// stop accepting once the ssh connection is lost or we're shutting down.
+	go func() {
+		<-ctx.Done()
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	// local connection Accept loop.
+	accept := func(local net.Listener, dialAddr string) error {
+		var delay time.Duration
+		for {
+			forward, err := local.Accept()
+			if err != nil {
+				// remote listeners return EOF when the connection is lost.
+				if ctx.Err() != nil || err == io.EOF {
+					return nil
+				}
+				if isTemporary(err) {
+					if !backoffAccept(ctx, logger, err, &delay, opts.AcceptBackoff) {
+						return nil
+					}
+					continue
+				}
+				return fmt.Errorf("accept error: %v", err)
+			}
+			delay = 0
+
+			logger.Debug("Connection accepted", "client", forward.RemoteAddr().String())
+
+			if !allow.allows(forward.RemoteAddr()) {
+				logger.Warn("Source not allowed, rejecting connection", "client", forward.RemoteAddr().String())
+				forward.Close()
+				continue
+			}
+
+			// the slot is acquired first as a connection let through a
+			// half-open breaker must go on to dial, or the breaker never
+			// closes.
+			released, ok := acquire(limit, opts.connLimit)
+			if !ok {
+				logger.Warn("Connection limit reached, rejecting connection", "client", forward.RemoteAddr().String())
+				stats.rejected(rejectLimit)
+				forward.Close()
+				continue
+			}
+			if !brk.allow() {
+				logger.Info("Target failing, rejecting connection", "client", forward.RemoteAddr().String(), "address", dialAddr)
+				stats.rejected(rejectBreaker)
+				released()
+				forward.Close()
+				continue
+			}
+
+			opts.tuneTCPKeepAlive(forward, clientKeepAlive)
+			conns.add()
+			conn := stats.connOpened()
+			go func() {
+				defer conns.done()
+				defer conn.closed()
+				defer released()
+
+				dialAddr := dialAddr
+				if template {
+					dialAddr = expandRemote(dialAddr, forward.LocalAddr().String(), forward.RemoteAddr().String())
+				}
+
+				// dial here so a slow or retried dial doesn't hold up accepting.
+				var remote net.Conn
+				var err error
+				if remote = warm.get(); remote != nil {
+					logger.Debug("Using pre-dialled connection", "address", dialAddr)
+				} else if pool != nil {
+					remote, dialAddr, err = pool.dial(ctx, logger, dial, endpoint.DialRetries)
+				} else {
+					remote, err = dialRetry(ctx, logger, dial, dialAddr, endpoint.DialRetries)
+				}
+				if err != nil {
+					logger.Warn("Dial failed", "address", dialAddr, "error", err)
+					stats.dialFailed()
+					brk.dialFailed(logger, dialAddr)
+					forward.Close()
+					return
+				}
+				brk.dialled(logger, dialAddr)
+				opts.tuneTCP(remote)
+
+				if endpoint.ProxyProtocol != "" {
+					if _, err := remote.Write(proxyHeader(endpoint.ProxyProtocol, forward.RemoteAddr(), forward.LocalAddr())); err != nil {
+						logger.Warn("Failed to send PROXY header", "address", dialAddr, "error", err)
+						forward.Close()
+						remote.Close()
+						return
+					}
+				}
+
+				logger.Debug("Dialled target", "client", forward.RemoteAddr().String(), "address", dialAddr)
+
+				local := forward
+				if idleTimeout > 0 {
+					a := newActivity()
+					local, remote = a.conn(local), a.conn(remote)
+					stop := a.watch(idleTimeout, func() {
+						logger.Info("Closing idle connection", "client", local.RemoteAddr().String(), "idle_timeout", idleTimeout)
+						local.Close()
+						remote.Close()
+					})
+					defer stop()
+				}
+
+				handleClient(conns.ctx, logger, throttle(local, forwardThrottle), throttle(remote, remoteThrottle), conn, opts.buffers)
+			}()
+		}
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(l net.Listener, dialAddr string) {
+			errs <- accept(l, dialAddr)
+		}(l, targets[i])
+	}
+
+	var first error
+	for range listeners {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
+
+// acceptBackoffMin is the first wait after a temporary accept error, and
+// defaultAcceptBackoff the longest when Options.AcceptBackoff is unset.
+const (
+	acceptBackoffMin     = 5 * time.Millisecond
+	defaultAcceptBackoff = time.Second
+)
+
+// isTemporary reports whether the accept error err is likely to clear by
+// itself, rather than the listener being broken.
+func isTemporary(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
+
+// backoffAccept waits before accepting again after the temporary accept error
+// err, reporting false if ctx is done first. delay holds the previous wait,
+// which doubles from acceptBackoffMin up to longest, and is reset by the
+// caller once an accept succeeds.
+func backoffAccept(ctx context.Context, logger *slog.Logger, err error, delay *time.Duration, longest time.Duration) bool {
+	*delay *= 2
+	if *delay < acceptBackoffMin {
+		*delay = acceptBackoffMin
+	}
+	if *delay > longest {
+		*delay = longest
+	}
+	logger.Warn("Accept failed, retrying", "error", err, "retry_in", *delay)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(*delay):
+		return true
+	}
+}
+
+// dialRetryDelay is the delay between attempts to dial an endpoint's target.
+const dialRetryDelay = 250 * time.Millisecond
+
+// dialRetry dials addr, retrying up to retries times after dialRetryDelay
+// unless ctx is done first.
+func dialRetry(ctx context.Context, logger *slog.Logger, dial func(network, addr string) (net.Conn, error), addr string, retries int) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := dial(splitNetwork(addr))
+		if err == nil || attempt >= retries {
+			return conn, err
+		}
+		logger.Info("Dial failed, retrying", "address", addr, "attempt", attempt+1, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(dialRetryDelay):
+		}
+	}
+}
+
+// bindRetryDelay is the delay between attempts to listen on a local address.
+const bindRetryDelay = 200 * time.Millisecond
+
+// listenLocal listens on the local address, first removing a stale Unix domain
+// socket left behind by a previous run. An address that's still in use by a
+// previous run is retried up to retries times, bindRetryDelay apart. TCP
+// listeners already set SO_REUSEADDR, so connections in TIME_WAIT don't
+// prevent the bind. A positive backlog replaces the kernel's largest, failing
+// to set it is logged rather than failing the listen.
+func listenLocal(network, addr string, retries, backlog int) (net.Listener, error) {
+	if network == "unix" {
+		removeStaleSocket(addr)
+	}
+
+	for attempt := 0; ; attempt++ {
+		l, err := net.Listen(network, addr)
+		if err == nil {
+			listenBacklog(l, backlog)
+		}
+		if err == nil || attempt >= retries || !errors.Is(err, syscall.EADDRINUSE) {
+			return l, err
+		}
+		slog.Info("Address in use, retrying", "address", addr, "attempt", attempt+1)
+		time.Sleep(bindRetryDelay)
+	}
+}
+
+// listenBacklog sets the backlog of l unless it's zero, logging a failure.
+func listenBacklog(l net.Listener, backlog int) {
+	if backlog <= 0 {
+		return
+	}
+	if err := setBacklog(l, backlog); err != nil {
+		slog.Warn("Failed to set the listen backlog", "address", l.Addr().String(), "backlog", backlog, "error", err)
+	}
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on it.
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		// in use, leave it for the listen to fail.
+		conn.Close()
+		return
+	}
+
+	slog.Info("Removing stale socket", "path", path)
+	os.Remove(path)
+}
+
+// handleClient copies data between forward and remote with buffers from
+// buffers, recording the bytes in conn as they're copied, and returns the
+// totals in each direction once both are complete. When one direction reaches
+// EOF only the write side of its destination is closed, so the other direction
+// can drain before both connections are closed. Both are closed early if ctx
+// is done or a copy fails. Only the first failure of the connection is logged,
+// as the other direction then fails too, and expected ones such as resets are
+// logged at debug level. The totals are logged at debug level.
+func handleClient(ctx context.Context, logger *slog.Logger, forward net.Conn, remote net.Conn, conn *connStats, buffers *sync.Pool) (localToRemote, remoteToLocal int64) {
+	start := time.Now()
+	close := func() {
+		forward.Close()
+		remote.Close()
+	}
+	stop := context.AfterFunc(ctx, close)
+	defer stop()
+
+	var failed sync.Once
+	copyFailed := func(direction string, err error) {
+		failed.Do(func() {
+			// the connections were closed deliberately once ctx is done.
+			if ctx.Err() != nil {
+				return
+			}
+			level := slog.LevelWarn
+			if isDisconnect(err) {
+				level = slog.LevelDebug
+			}
+			logger.Log(context.Background(), level, "Copy failed", "client", forward.RemoteAddr().String(), "direction", direction, "error", err)
+		})
+		close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Start remote -> local data transfer
+	go func(f net.Conn, r net.Conn) {
+		defer wg.Done()
+		var err error
+		remoteToLocal, err = copyBuffered(f, r, buffers, conn.received)
+		if err != nil && err != io.EOF {
+			copyFailed("remote->local", err)
+			return
+		}
+		closeWrite(f, close)
+	}(forward, remote)
+
+	// Start local -> remote data transfer
+	go func(f net.Conn, r net.Conn) {
+		defer wg.Done()
+		var err error
+		localToRemote, err = copyBuffered(r, f, buffers, conn.sent)
+		if err != nil && err != io.EOF {
+			copyFailed("local->remote", err)
+			return
+		}
+		closeWrite(r, close)
+	}(forward, remote)
+
+	wg.Wait()
+	close()
+	logger.Debug("Connection closed", "client", forward.RemoteAddr().String(), "local_to_remote", localToRemote, "remote_to_local", remoteToLocal, "duration", time.Since(start))
+	return localToRemote, remoteToLocal
+}
+
+// isDisconnect reports whether the copy error err is a peer going away as
+// clients routinely do, rather than a problem worth a warning.
+func isDisconnect(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// defaultCopyBufferSize is the size of the copy buffers when
+// Options.CopyBufferSize is unset.
+const defaultCopyBufferSize = 32 * 1024
+
+// tuneTCP applies TCPNoDelay and TCPKeepAlive to conn if it's a TCP connection,
+// ssh channels are left alone as the client's connection to the host carries
+// them.
+func (o *Options) tuneTCP(conn net.Conn) {
+	o.tuneTCPKeepAlive(conn, o.TCPKeepAlive)
+}
+
+// tuneTCPKeepAlive is tuneTCP with a keepalive period of period rather than
+// TCPKeepAlive.
+func (o *Options) tuneTCPKeepAlive(conn net.Conn, period time.Duration) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcp.SetNoDelay(o.TCPNoDelay)
+	tcp.SetKeepAlive(period > 0)
+	if period > 0 {
+		tcp.SetKeepAlivePeriod(period)
+	}
+}
+
+// newCopyBuffers returns a pool of size byte copy buffers, so they're reused
+// across connections.
+func newCopyBuffers(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// copyBuffered copies src to dst with a buffer from buffers, passing the size of
+// each write to counted as it's made so the totals are current during long
+// transfers. Neither side is allowed to copy directly, as TCP connections can,
+// since that would bypass the count.
+func copyBuffered(dst io.Writer, src io.Reader, buffers *sync.Pool, counted func(int64)) (int64, error) {
+	buf := buffers.Get().(*[]byte)
+	defer buffers.Put(buf)
+	return io.CopyBuffer(countingWriter{dst, counted}, readerOnly{src}, *buf)
+}
+
+// countingWriter passes the bytes of each write to counted. It hides any
+// io.ReaderFrom of the Writer.
+type countingWriter struct {
+	io.Writer
+	counted func(int64)
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.counted(int64(n))
+	return n, err
+}
+
+// readerOnly hides any io.WriterTo of the Reader, so io.CopyBuffer's own loop
+// is used.
+type readerOnly struct {
+	io.Reader
+}
+
+// closeWriter is implemented by connections that support half-close, such as
+// *net.TCPConn and ssh channels.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite signals EOF to the peer of conn, falling back to fallback when
+// conn can't be half-closed.
+func closeWrite(conn net.Conn, fallback func()) {
+	if cw, ok := conn.(closeWriter); ok && cw.CloseWrite() == nil {
+		return
+	}
+	fallback()
+}
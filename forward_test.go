@@ -0,0 +1,244 @@
+package sshforward
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// dialForward connects to the endpoint listening on addr.
+func dialForward(t testing.TB, addr string) *net.TCPConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*net.TCPConn)
+}
+
+// waitFor fails the test unless cond is met within 5s.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v after 5s", what)
+		}
+	}
+}
+
+func TestForwardRoundTrip(t *testing.T) {
+	client := startSSHServer(t, nil)
+	backend := startBackend(t, "127.0.0.1:0", echo)
+	local := freeAddr(t)
+	stats := startForward(t, client, Endpoint{Name: "echo", LocalAddr: local, RemoteAddr: backend})
+
+	conn := dialForward(t, local)
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Errorf("echoed %q, want %q", got, msg)
+		}
+	}
+	// counted while the connection is still open.
+	waitFor(t, "bytes not counted", func() bool {
+		return stats.bytesLocalToRemote() == 10 && stats.bytesRemoteToLocal() == 10
+	})
+	conn.Close()
+
+	waitFor(t, "connection still active", func() bool { return stats.activeConns() == 0 })
+	if got := stats.totalConns(); got != 1 {
+		t.Errorf("totalConns() = %v, want 1", got)
+	}
+}
+
+func TestForwardIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	l.Close()
+
+	client := startSSHServer(t, nil)
+	backend := startBackend(t, "[::1]:0", echo)
+	stats := startForward(t, client, Endpoint{Name: "v6", LocalAddr: "[::1]:0", RemoteAddr: backend})
+
+	addr := stats.listenAddrs()[0]
+	if host, _, _ := net.SplitHostPort(addr); host != "::1" {
+		t.Errorf("listening on %v, want [::1]", addr)
+	}
+	conn := dialForward(t, addr)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("echoed %q, want hello", got)
+	}
+}
+
+func TestForwardResolvesRemotely(t *testing.T) {
+	// .invalid never resolves, RFC 6761, so only the server knows the name.
+	const name = "db.bastion.invalid"
+	if addrs, err := net.LookupHost(name); err == nil {
+		t.Skipf("%v resolves locally to %v", name, addrs)
+	}
+
+	backend := startBackend(t, "127.0.0.1:0", echo)
+	_, port, _ := net.SplitHostPort(backend)
+	client := startSSHServer(t, map[string]string{name: "127.0.0.1"})
+	local := freeAddr(t)
+	startForward(t, client, Endpoint{Name: "db", LocalAddr: local, RemoteAddr: net.JoinHostPort(name, port)})
+
+	conn := dialForward(t, local)
+	if _, err := conn.Write([]byte("select 1")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 8)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("forwarding to %v: %v", name, err)
+	}
+	if string(got) != "select 1" {
+		t.Errorf("echoed %q, want select 1", got)
+	}
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	client := startSSHServer(t, nil)
+	// the backend only replies once the request is complete.
+	backend := startBackend(t, "127.0.0.1:0", func(conn net.Conn) {
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "read %d bytes", len(request))
+	})
+	local := freeAddr(t)
+	startForward(t, client, Endpoint{Name: "half", LocalAddr: local, RemoteAddr: backend})
+
+	conn := dialForward(t, local)
+	request := bytes.Repeat([]byte("x"), 100000)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "read 100000 bytes"; string(response) != want {
+		t.Errorf("response %q, want %q", response, want)
+	}
+}
+
+func TestForwardDialFailure(t *testing.T) {
+	client := startSSHServer(t, nil)
+	// nothing listens on the port.
+	local := freeAddr(t)
+	stats := startForward(t, client, Endpoint{Name: "down", LocalAddr: local, RemoteAddr: freeAddr(t)})
+
+	// each connection is accepted and closed, the endpoint keeps listening.
+	for i := 0; i < 2; i++ {
+		conn := dialForward(t, local)
+		if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Read() = %v, %v, want the connection closed", n, err)
+		}
+	}
+	waitFor(t, "connection still active", func() bool { return stats.activeConns() == 0 })
+	if !stats.isListening() {
+		t.Error("endpoint stopped listening after a failed dial")
+	}
+}
+
+func TestForwardProbeSkipsClientTemplate(t *testing.T) {
+	client := startSSHServer(t, nil)
+	// probed with an empty {client_host} the target would be dialled as
+	// :port, so nothing may listen on the port for the probe to fail.
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	local := freeAddr(t)
+	stats := startForward(t, client, Endpoint{Name: "probe", LocalAddr: local, RemoteAddr: "{client_host}:" + port, Probe: true})
+	if !stats.isListening() {
+		t.Error("endpoint with a {client_host} template isn't listening")
+	}
+}
+
+func TestListenLocalBacklog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("relies on Linux completing at most backlog+1 unaccepted connections")
+	}
+	l, err := listenLocal("tcp", "127.0.0.1:0", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// nothing is accepted, so once the backlog is full dials time out.
+	for i := 0; i < 4; i++ {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 200*time.Millisecond)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+	}
+	t.Error("4 connections completed with a backlog of 1")
+}
+
+// zeros is an endless stream of 0 bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkCopy compares io.Copy, which allocates a 32KiB buffer for every
+// copy, with copyBuffered's pooled buffers of several sizes. Each copy moves
+// 4MiB, as a bulk transfer through a connection would.
+func BenchmarkCopy(b *testing.B) {
+	const transfer = 4 << 20
+	// hide io.Discard's io.ReaderFrom, a connection has its own buffering.
+	dst := struct{ io.Writer }{io.Discard}
+
+	b.Run("io.Copy", func(b *testing.B) {
+		b.SetBytes(transfer)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := io.Copy(dst, io.LimitReader(zeros{}, transfer)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("copyBuffered/%dKiB", size>>10), func(b *testing.B) {
+			buffers := newCopyBuffers(size)
+			var copied int64
+			counted := func(n int64) { copied += n }
+			b.SetBytes(transfer)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := copyBuffered(dst, io.LimitReader(zeros{}, transfer), buffers, counted); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,25 @@
 module github.com/nfisher/sshforward
 
-go 1.13
+go 1.22
 
-require golang.org/x/crypto v0.1.0
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/kevinburke/ssh_config v1.2.0
+	github.com/prometheus/client_golang v1.11.1
+	golang.org/x/crypto v0.1.0
+	golang.org/x/sys v0.1.0
+	golang.org/x/term v0.1.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
+)
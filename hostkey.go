@@ -0,0 +1,156 @@
+package sshforward
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// parseHostKey returns the SHA256 fingerprint of a pinned host key, given
+// either as an authorized_keys line or as a fingerprint in the form printed by
+// ssh-keygen -l, with or without its SHA256: prefix.
+func parseHostKey(spec string) (string, error) {
+	if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(spec)); err == nil {
+		return ssh.FingerprintSHA256(key), nil
+	}
+
+	fingerprint := strings.TrimRight(strings.TrimPrefix(spec, "SHA256:"), "=")
+	hash, err := base64.RawStdEncoding.DecodeString(fingerprint)
+	if err != nil || len(hash) != 32 {
+		return "", fmt.Errorf("host key %q is neither an authorized_keys line nor a SHA256 fingerprint", spec)
+	}
+	return "SHA256:" + fingerprint, nil
+}
+
+// pinnedHostKey returns a HostKeyCallback that accepts only the host key
+// matching spec, see parseHostKey.
+func pinnedHostKey(spec string) ssh.HostKeyCallback {
+	want, err := parseHostKey(spec)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err != nil {
+			return err
+		}
+		if got := ssh.FingerprintSHA256(key); got != want {
+			return fmt.Errorf("host key %v for %v does not match the pinned host_key %v, possible MITM attack", got, hostname, want)
+		}
+		return nil
+	}
+}
+
+// UnverifiedHostKey returns a HostKeyCallback that rejects every host key
+// because known_hosts couldn't be loaded.
+func UnverifiedHostKey(reason error) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return fmt.Errorf("host key for %v can't be verified, set its host_key: %v", hostname, reason)
+	}
+}
+
+// The host key policies of NewHostKeyCallback.
+const (
+	HostKeyStrict   = "strict"
+	HostKeyTOFU     = "tofu"
+	HostKeyInsecure = "insecure"
+)
+
+// NewHostKeyCallback verifies host keys against the known_hosts file as policy
+// directs. HostKeyStrict rejects hosts that aren't in the file, HostKeyTOFU
+// trusts them on first use, adding their key to trustFile, which is created if
+// need be, so it's verified from then on while the known_hosts file is left
+// untouched, and HostKeyInsecure accepts any host key.
+func NewHostKeyCallback(filename, trustFile, policy string) (ssh.HostKeyCallback, error) {
+	switch policy {
+	case HostKeyInsecure:
+		slog.Warn("Host key verification is disabled")
+		return ssh.InsecureIgnoreHostKey(), nil
+	case HostKeyStrict, HostKeyTOFU:
+	default:
+		return nil, fmt.Errorf("unknown host key policy %q, expected %v, %v or %v", policy, HostKeyStrict, HostKeyTOFU, HostKeyInsecure)
+	}
+
+	files := []string{filename}
+	if policy == HostKeyTOFU {
+		if trustFile == "" {
+			return nil, errors.New("no file to trust host keys in specified, use -tofu-file")
+		}
+		if err := createKnownHosts(trustFile); err != nil {
+			return nil, err
+		}
+		// known_hosts is optional, the trusted keys may be the only ones.
+		files = []string{trustFile}
+		if _, err := os.Stat(filename); err == nil {
+			files = append(files, filename)
+		}
+	} else if filename == "" {
+		return nil, errors.New("no known_hosts file specified, use -known-hosts or -insecure")
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	// mu guards callback, which is reloaded once a host is trusted.
+	var mu sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				if policy == HostKeyTOFU {
+					return trustHostKey(trustFile, files, hostname, key, &callback)
+				}
+				return fmt.Errorf("host key for %v is unknown, add it to %v", hostname, filename)
+			}
+			return fmt.Errorf("host key for %v does not match %v:%d, possible MITM attack", hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		}
+		return err
+	}, nil
+}
+
+// createKnownHosts creates an empty known_hosts file, and its directory, unless
+// it already exists.
+func createKnownHosts(filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// trustHostKey appends the host's key to filename and reloads callback from
+// files.
+func trustHostKey(filename string, files []string, hostname string, key ssh.PublicKey, callback *ssh.HostKeyCallback) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to trust host key for %v: %v", hostname, err)
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to trust host key for %v: %v", hostname, err)
+	}
+	slog.Warn("Trusting host key on first use", "address", hostname, "type", key.Type(), "fingerprint", ssh.FingerprintSHA256(key), "file", filename)
+
+	reloaded, err := knownhosts.New(files...)
+	if err != nil {
+		return err
+	}
+	*callback = reloaded
+	return nil
+}
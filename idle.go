@@ -0,0 +1,68 @@
+package sshforward
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// activity records when data was last read from either side of a forwarded
+// connection.
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// conn returns conn with its reads recorded as activity.
+func (a *activity) conn(conn net.Conn) net.Conn {
+	return &activeConn{Conn: conn, activity: a}
+}
+
+// watch calls onIdle once there's been no activity for timeout. The returned
+// func stops watching.
+func (a *activity) watch(timeout time.Duration, onIdle func()) func() {
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		if idle := a.idle(); idle < timeout {
+			timer.Reset(timeout - idle)
+			return
+		}
+		onIdle()
+	})
+	return func() { timer.Stop() }
+}
+
+// activeConn is a net.Conn whose reads are recorded as activity.
+type activeConn struct {
+	net.Conn
+	activity *activity
+}
+
+func (c *activeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.activity.touch()
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying conn where it's supported.
+func (c *activeConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,76 @@
+package sshforward
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultKeepaliveMaxMissed is the keepalives that may be missed when
+// Options.KeepaliveMaxMissed is unset.
+const defaultKeepaliveMaxMissed = 3
+
+// keepaliveSettings returns the keepalive interval and max missed for host,
+// its overrides taking precedence over opts.
+func keepaliveSettings(host Host, opts Options) (time.Duration, int) {
+	interval, maxMissed := opts.KeepaliveInterval, opts.KeepaliveMaxMissed
+	if host.KeepaliveInterval > 0 {
+		interval = time.Duration(host.KeepaliveInterval) * time.Second
+	}
+	if host.KeepaliveMaxMissed > 0 {
+		maxMissed = host.KeepaliveMaxMissed
+	}
+	return interval, maxMissed
+}
+
+// keepalive sends a keepalive request on client every interval until ctx is
+// done. A request that errors or isn't answered within the interval is missed,
+// once maxMissed consecutive requests are missed the client is closed.
+func keepalive(ctx context.Context, logger *slog.Logger, client *ssh.Client, interval time.Duration, maxMissed int) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case err = <-reply:
+		case <-time.After(interval):
+			err = fmt.Errorf("no reply within %v", interval)
+		}
+
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		logger.Warn("Keepalive missed", "missed", missed, "max_missed", maxMissed, "error", err)
+		if missed >= maxMissed {
+			logger.Error("Closing connection after missed keepalives", "missed", missed)
+			client.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package sshforward
+
+import "context"
+
+// limiter bounds the number of concurrent connections. A nil limiter is
+// unlimited.
+type limiter chan struct{}
+
+// newLimiter returns a limiter allowing n concurrent connections, or nil when n
+// isn't positive.
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+// acquire takes a slot from each of limits, reporting false without holding any
+// if one of them is full. The returned func releases the slots.
+func acquire(limits ...limiter) (func(), bool) {
+	for i, l := range limits {
+		if l == nil {
+			continue
+		}
+		select {
+		case l <- struct{}{}:
+		default:
+			release(limits[:i])
+			return nil, false
+		}
+	}
+	return func() { release(limits) }, true
+}
+
+// wait takes a slot from l, waiting for one to free up until ctx is done, in
+// which case it reports false. The returned func releases the slot.
+func (l limiter) wait(ctx context.Context) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+func release(limits []limiter) {
+	for _, l := range limits {
+		if l != nil {
+			<-l
+		}
+	}
+}
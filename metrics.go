@@ -0,0 +1,81 @@
+package sshforward
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics, served on /metrics once registered, see Collectors.
+var (
+	bytesCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sshforward",
+		Name:      "bytes_total",
+		Help:      "Bytes copied through an endpoint in each direction.",
+	}, []string{"environment", "host", "endpoint", "direction"})
+
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sshforward",
+		Name:      "active_connections",
+		Help:      "Connections currently being forwarded through an endpoint.",
+	}, []string{"environment", "host", "endpoint"})
+
+	dialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sshforward",
+		Name:      "dial_failures_total",
+		Help:      "Failed attempts to dial the target of an endpoint.",
+	}, []string{"environment", "host", "endpoint"})
+
+	openChannels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sshforward",
+		Name:      "open_channels",
+		Help:      "Channels currently open to a host for forwarded connections.",
+	}, []string{"environment", "host"})
+
+	drainingGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sshforward",
+		Name:      "draining",
+		Help:      "1 once the tunnels are draining and no longer accept connections.",
+	})
+
+	rejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sshforward",
+		Name:      "rejected_connections_total",
+		Help:      "Connections rejected, with the reason limit when a connection limit was reached or breaker while the endpoint's breaker was open.",
+	}, []string{"environment", "host", "endpoint", "reason"})
+)
+
+// The reasons a connection is rejected, labelling rejectedConnections.
+const (
+	rejectLimit   = "limit"
+	rejectBreaker = "breaker"
+)
+
+// Collectors returns the tunnels' metrics for registering with a Prometheus
+// registry. Nothing is registered on import, so they don't clash with an
+// importer's own metrics. /metrics serves prometheus.DefaultGatherer, so they
+// must be registered with prometheus.DefaultRegisterer to appear there.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{bytesCopied, activeConnections, dialFailures, drainingGauge, openChannels, rejectedConnections}
+}
+
+// endpointMetrics are the metrics for a single endpoint.
+type endpointMetrics struct {
+	localToRemote prometheus.Counter
+	remoteToLocal prometheus.Counter
+	active        prometheus.Gauge
+	dialFailures  prometheus.Counter
+	// rejected counts rejected connections by their reason.
+	rejected map[string]prometheus.Counter
+}
+
+func newEndpointMetrics(environment, host, endpoint string) endpointMetrics {
+	return endpointMetrics{
+		localToRemote: bytesCopied.WithLabelValues(environment, host, endpoint, "local_to_remote"),
+		remoteToLocal: bytesCopied.WithLabelValues(environment, host, endpoint, "remote_to_local"),
+		active:        activeConnections.WithLabelValues(environment, host, endpoint),
+		dialFailures:  dialFailures.WithLabelValues(environment, host, endpoint),
+		rejected: map[string]prometheus.Counter{
+			rejectLimit:   rejectedConnections.WithLabelValues(environment, host, endpoint, rejectLimit),
+			rejectBreaker: rejectedConnections.WithLabelValues(environment, host, endpoint, rejectBreaker),
+		},
+	}
+}
@@ -0,0 +1,146 @@
+package sshforward
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// CombineAgents returns an agent offering the keys of every one of agents,
+// each key once, in the order of the agents. Requests to sign are sent to the
+// first agent holding the key. It returns nil if there are no agents.
+func CombineAgents(agents []agent.Agent) agent.Agent {
+	switch len(agents) {
+	case 0:
+		return nil
+	case 1:
+		return agents[0]
+	}
+	return multiAgent(agents)
+}
+
+// multiAgent combines several agents, see CombineAgents. Keys are added to the
+// first agent and removed from all of them.
+type multiAgent []agent.Agent
+
+// List returns the keys of every agent, skipping duplicates and agents that
+// fail.
+func (m multiAgent) List() ([]*agent.Key, error) {
+	var keys []*agent.Key
+	seen := make(map[string]bool)
+	var lastErr error
+	failed := 0
+	for _, a := range m {
+		list, err := a.List()
+		if err != nil {
+			slog.Warn("ssh-agent list error", "error", err)
+			lastErr = err
+			failed++
+			continue
+		}
+		for _, key := range list {
+			if blob := string(key.Marshal()); !seen[blob] {
+				seen[blob] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if failed == len(m) {
+		return nil, lastErr
+	}
+	return keys, nil
+}
+
+// Sign has the first agent holding key sign data.
+func (m multiAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	a, err := m.holder(key)
+	if err != nil {
+		return nil, err
+	}
+	return a.Sign(key, data)
+}
+
+// holder returns the first agent holding key.
+func (m multiAgent) holder(key ssh.PublicKey) (agent.Agent, error) {
+	want := key.Marshal()
+	for _, a := range m {
+		list, err := a.List()
+		if err != nil {
+			continue
+		}
+		for _, k := range list {
+			if bytes.Equal(k.Marshal(), want) {
+				return a, nil
+			}
+		}
+	}
+	return nil, errors.New("no agent holds the key")
+}
+
+// Signers returns the signers of every agent, skipping duplicate keys and
+// agents that fail.
+func (m multiAgent) Signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	seen := make(map[string]bool)
+	for _, a := range m {
+		list, err := a.Signers()
+		if err != nil {
+			slog.Warn("ssh-agent signers error", "error", err)
+			continue
+		}
+		for _, signer := range list {
+			if blob := string(signer.PublicKey().Marshal()); !seen[blob] {
+				seen[blob] = true
+				signers = append(signers, signer)
+			}
+		}
+	}
+	return signers, nil
+}
+
+func (m multiAgent) Add(key agent.AddedKey) error {
+	return m[0].Add(key)
+}
+
+// Remove removes key from every agent holding it.
+func (m multiAgent) Remove(key ssh.PublicKey) error {
+	removed := false
+	var lastErr error
+	for _, a := range m {
+		if err := a.Remove(key); err != nil {
+			lastErr = err
+			continue
+		}
+		removed = true
+	}
+	if removed {
+		return nil
+	}
+	return lastErr
+}
+
+func (m multiAgent) RemoveAll() error {
+	return m.each(func(a agent.Agent) error { return a.RemoveAll() })
+}
+
+func (m multiAgent) Lock(passphrase []byte) error {
+	return m.each(func(a agent.Agent) error { return a.Lock(passphrase) })
+}
+
+func (m multiAgent) Unlock(passphrase []byte) error {
+	return m.each(func(a agent.Agent) error { return a.Unlock(passphrase) })
+}
+
+// each calls fn for every agent, returning the first error.
+func (m multiAgent) each(fn func(agent.Agent) error) error {
+	var first error
+	for _, a := range m {
+		if err := fn(a); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
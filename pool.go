@@ -0,0 +1,93 @@
+package sshforward
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetSkip is how long a target of an endpoint with several remote
+// addresses is skipped after failing to dial.
+const targetSkip = 10 * time.Second
+
+// targetPool spreads connections round-robin across an endpoint's remote
+// addresses, skipping those that recently failed to dial.
+type targetPool struct {
+	addrs []string
+
+	mu   sync.Mutex
+	next int
+	// skipUntil is when each failed target is next tried in its turn.
+	skipUntil map[string]time.Time
+}
+
+// newTargetPool returns a pool for addrs, or nil when there's only one.
+func newTargetPool(addrs []string) *targetPool {
+	if len(addrs) < 2 {
+		return nil
+	}
+	return &targetPool{addrs: addrs, skipUntil: make(map[string]time.Time)}
+}
+
+// order returns the targets to try for a new connection, starting with the
+// one whose turn it is. Skipped targets come last so they're only tried once
+// the rest have failed.
+func (p *targetPool) order() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next
+	p.next = (p.next + 1) % len(p.addrs)
+
+	now := time.Now()
+	var up, skipped []string
+	for i := range p.addrs {
+		addr := p.addrs[(start+i)%len(p.addrs)]
+		if now.Before(p.skipUntil[addr]) {
+			skipped = append(skipped, addr)
+		} else {
+			up = append(up, addr)
+		}
+	}
+	return append(up, skipped...)
+}
+
+// dialed records the outcome of dialling addr.
+func (p *targetPool) dialed(addr string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.skipUntil[addr] = time.Now().Add(targetSkip)
+	} else {
+		delete(p.skipUntil, addr)
+	}
+}
+
+// dial dials the targets in order until one succeeds, returning it and its
+// address. A pass over the targets that all fail is retried up to retries
+// times, as dialRetry does for a single target.
+func (p *targetPool) dial(ctx context.Context, logger *slog.Logger, dial func(network, addr string) (net.Conn, error), retries int) (net.Conn, string, error) {
+	var addr string
+	conn, err := dialRetry(ctx, logger, func(string, string) (net.Conn, error) {
+		var errs []string
+		for _, addr = range p.order() {
+			conn, err := dial(splitNetwork(addr))
+			p.dialed(addr, err)
+			if err == nil {
+				return conn, nil
+			}
+			logger.Info("Target failed, trying the next", "address", addr, "error", err, "skip_for", targetSkip)
+			errs = append(errs, fmt.Sprintf("%v: %v", addr, err))
+		}
+		return nil, fmt.Errorf("every target failed, %v", strings.Join(errs, ", "))
+	}, strings.Join(p.addrs, ","), retries)
+	if err != nil {
+		return nil, strings.Join(p.addrs, ","), err
+	}
+	return conn, addr, nil
+}
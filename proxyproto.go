@@ -0,0 +1,64 @@
+package sshforward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// The versions of the PROXY protocol an endpoint's ProxyProtocol may be.
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader returns the PROXY protocol header of version for a connection
+// from the client src accepted on dst. Addresses that aren't IP addresses,
+// e.g. Unix domain sockets, are sent as unknown, v2's LOCAL command.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	srcAddr, srcErr := netip.ParseAddrPort(src.String())
+	dstAddr, dstErr := netip.ParseAddrPort(dst.String())
+	known := srcErr == nil && dstErr == nil
+	srcIP, dstIP := srcAddr.Addr().Unmap(), dstAddr.Addr().Unmap()
+	v4 := srcIP.Is4() && dstIP.Is4()
+
+	if version == ProxyProtocolV1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case v4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %v %v %v %v\r\n", srcIP, dstIP, srcAddr.Port(), dstAddr.Port()))
+		default:
+			// a mixed pair is sent as IPv4-mapped IPv6 addresses.
+			return []byte(fmt.Sprintf("PROXY TCP6 %v %v %v %v\r\n", netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16()), srcAddr.Port(), dstAddr.Port()))
+		}
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	var addrs []byte
+	switch {
+	case !known:
+		// version 2, LOCAL, with an unspecified family.
+		header = append(header, 0x20, 0x00)
+	case v4:
+		// version 2, PROXY, TCP over IPv4.
+		header = append(header, 0x21, 0x11)
+		src4, dst4 := srcIP.As4(), dstIP.As4()
+		addrs = append(append(addrs, src4[:]...), dst4[:]...)
+	default:
+		// version 2, PROXY, TCP over IPv6.
+		header = append(header, 0x21, 0x21)
+		src16, dst16 := srcIP.As16(), dstIP.As16()
+		addrs = append(append(addrs, src16[:]...), dst16[:]...)
+	}
+	if known {
+		addrs = binary.BigEndian.AppendUint16(addrs, srcAddr.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dstAddr.Port())
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
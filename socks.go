@@ -0,0 +1,199 @@
+package sshforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol values from RFC 1928.
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0x00
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksSucceeded        = 0x00
+	socksHostUnreachable  = 0x04
+	socksCmdNotSupported  = 0x07
+	socksAtypNotSupported = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a client may take to issue its request.
+const socksHandshakeTimeout = 30 * time.Second
+
+// serveSocks runs a SOCKS5 proxy bound to addr, satisfying CONNECT requests by
+// dialling the requested address through client, until ctx is done. Each
+// accepted connection is tracked in conns and recorded in stats. Connections
+// beyond the MaxConns of opts are rejected.
+func serveSocks(ctx context.Context, logger *slog.Logger, client *channelClient, addr string, conns *connGroup, stats *endpointStats, opts *Options) error {
+	logger.Info("SOCKS proxy listening", "address", addr)
+
+	local, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("socks port bind error: %v", err)
+	}
+	listenBacklog(local, opts.ListenBacklog)
+	stats.setAddrs([]string{local.Addr().String()})
+	stats.setListening(true)
+	defer stats.setListening(false)
+
+	// stop accepting once the ssh connection is lost or we're shutting down.
+	go func() {
+		<-ctx.Done()
+		local.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		forward, err := local.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if isTemporary(err) {
+				if !backoffAccept(ctx, logger, err, &delay, opts.AcceptBackoff) {
+					return nil
+				}
+				continue
+			}
+			return fmt.Errorf("socks accept error: %v", err)
+		}
+		delay = 0
+
+		logger.Debug("Connection accepted", "client", forward.RemoteAddr().String())
+
+		released, ok := acquire(opts.connLimit)
+		if !ok {
+			logger.Warn("Connection limit reached, rejecting connection", "client", forward.RemoteAddr().String())
+			stats.rejected(rejectLimit)
+			forward.Close()
+			continue
+		}
+
+		opts.tuneTCP(forward)
+		conns.add()
+		conn := stats.connOpened()
+		go func() {
+			defer conns.done()
+			defer conn.closed()
+			defer released()
+			remote, err := socksConnect(forward, func(network, addr string) (net.Conn, error) {
+				return client.dial(ctx, network, addr)
+			})
+			if err != nil {
+				logger.Warn("SOCKS request failed", "error", err)
+				forward.Close()
+				return
+			}
+			handleClient(conns.ctx, logger, forward, remote, conn, opts.buffers)
+		}()
+	}
+}
+
+// socksConnect negotiates a SOCKS5 CONNECT request on conn and dials the
+// requested address with dial.
+func socksConnect(conn net.Conn, dial func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// greeting: VER NMETHODS METHODS...
+	// large enough for the version, count and up to 255 methods.
+	buf := make([]byte, 2+255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == socksAuthNone {
+			method = socksAuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksAuthNoAcceptable {
+		return nil, errors.New("no acceptable socks auth method")
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return nil, err
+	}
+	cmd, atyp := buf[1], buf[3]
+
+	var host string
+	switch atyp {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		domain := buf[1 : 1+int(buf[0])]
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAtypNotSupported)
+		return nil, fmt.Errorf("unsupported socks address type %d", atyp)
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+
+	if cmd != socksCmdConnect {
+		socksReply(conn, socksCmdNotSupported)
+		return nil, fmt.Errorf("unsupported socks command %d", cmd)
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	remote, err := dial("tcp", addr)
+	if err != nil {
+		socksReply(conn, socksHostUnreachable)
+		return nil, fmt.Errorf("remote dial error: %v", err)
+	}
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		remote.Close()
+		return nil, err
+	}
+
+	return remote, nil
+}
+
+// socksReply writes a reply with the given status. The bound address isn't
+// meaningful for a tunnelled connection so is always reported as 0.0.0.0:0.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,76 @@
+package sshforward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// SSHConfig resolves host aliases from an ssh_config(5) file.
+type SSHConfig struct {
+	cfg *ssh_config.Config
+}
+
+// LoadSSHConfig parses the ssh_config file at filename.
+func LoadSSHConfig(filename string) (*SSHConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := ssh_config.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return &SSHConfig{cfg: cfg}, nil
+}
+
+// resolve treats the address of host as an ssh_config alias when it has no
+// port, filling in its HostName, Port, User and ProxyJump. The fields set on
+// host take precedence over ssh_config. Host is returned unchanged when c is
+// nil.
+func (c *SSHConfig) resolve(host Host) Host {
+	if c == nil || host.Address == "" {
+		return host
+	}
+	if _, _, err := net.SplitHostPort(host.Address); err == nil {
+		return host
+	}
+
+	alias := host.Address
+	if hostname := c.get(alias, "HostName"); hostname != "" {
+		host.Address = strings.ReplaceAll(hostname, "%h", alias)
+	}
+	if host.Port == 0 {
+		host.Port, _ = strconv.Atoi(c.get(alias, "Port"))
+	}
+	if host.User == "" {
+		host.User = c.get(alias, "User")
+	}
+	if jump := c.get(alias, "ProxyJump"); host.Jump == "" && jump != "none" {
+		host.Jump = jump
+	}
+	return host
+}
+
+// get returns the value of key for alias, or an empty string if it isn't set
+// or can't be read.
+func (c *SSHConfig) get(alias, key string) (value string) {
+	// ssh_config panics on Match directives, which aren't supported.
+	defer func() {
+		if recover() != nil {
+			value = ""
+		}
+	}()
+
+	value, err := c.cfg.Get(alias, key)
+	if err != nil {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,216 @@
+package sshforward
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startSSHServer starts an in-process ssh server, see listenSSH, and returns
+// a client connected to it, closed when the test ends.
+func startSSHServer(t testing.TB, hosts map[string]string) *ssh.Client {
+	t.Helper()
+
+	addr, hostKey := listenSSH(t, hosts)
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// listenSSH starts an in-process ssh server with a generated host key,
+// accepting any client, and returns its address and host key. The server
+// serves direct-tcpip channels by dialling the target itself, first looking
+// its host up in hosts so names only the server can resolve can be tested.
+// It's closed when the test ends.
+func listenSSH(t testing.TB, hosts map[string]string) (string, ssh.PublicKey) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, hosts)
+		}
+	}()
+	return l.Addr().String(), signer.PublicKey()
+}
+
+// serveSSH serves the direct-tcpip channels of an ssh connection, rejecting
+// any other channel type.
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, hosts map[string]string) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+		go serveDirectTCPIP(newChannel, hosts)
+	}
+}
+
+// serveDirectTCPIP dials the target of a direct-tcpip channel, RFC 4254 7.2,
+// and relays between them, half-closing each side as the other reaches EOF.
+func serveDirectTCPIP(newChannel ssh.NewChannel, hosts map[string]string) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	host := target.Host
+	if resolved, ok := hosts[host]; ok {
+		host = resolved
+	}
+	backend, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		backend.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(channel, backend)
+		channel.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(backend, channel)
+		backend.(*net.TCPConn).CloseWrite()
+	}()
+	wg.Wait()
+	channel.Close()
+	backend.Close()
+}
+
+// startBackend starts a TCP service on addr, handling each connection with
+// handle, and returns the address it's listening on.
+func startBackend(t testing.TB, addr string, handle func(net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// echo writes back everything read from conn.
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// freeAddr returns a loopback address with a port nothing is listening on.
+func freeAddr(t testing.TB) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startForward forwards endpoint through client until the test ends, and
+// returns its stats once it's listening.
+func startForward(t testing.TB, client *ssh.Client, endpoint Endpoint) *endpointStats {
+	t.Helper()
+
+	opts := New(ssh.ClientConfig{}, Options{}).opts
+	hs := newHostStats("test", Host{Name: "host", Endpoints: []Endpoint{endpoint}}, opts.events())
+	stats := hs.endpoint(endpoint.Name)
+	channels := &channelClient{Client: client, stats: hs}
+	conns := newConnGroup(nil)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var err error
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		err = forwardEndpoint(ctx, logger, channels, endpoint, conns, stats, &opts, nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		conns.close()
+		<-exited
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !stats.isListening() {
+		select {
+		case <-exited:
+			t.Fatalf("forwardEndpoint() = %v before listening", err)
+		case <-time.After(5 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("endpoint not listening after 5s")
+		}
+	}
+	return stats
+}
@@ -0,0 +1,476 @@
+package sshforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// stats records the state of every host and endpoint for reporting. The
+// counters are updated atomically by the forwarders, the hosts and endpoints
+// may be replaced when the config is reloaded.
+type stats struct {
+	// started is when the tunnels were created, for the uptime.
+	started time.Time
+	// draining is set once the tunnels are draining.
+	draining int32
+
+	mu          sync.RWMutex
+	environment string
+	hosts       []*hostStats
+}
+
+// hostStats records the state of a host's connection.
+type hostStats struct {
+	mu sync.RWMutex
+	// environment labels the metrics, it's fixed for the life of the stats.
+	environment string
+	host        Host
+	endpoints   map[string]*endpointStats
+	// socks is nil unless the host has a SOCKS proxy.
+	socks *endpointStats
+
+	connected int32
+	channels  int64
+	// channelsGauge is nil until the host is set.
+	channelsGauge prometheus.Gauge
+	// events are sent the host's and its endpoints' lifecycle events.
+	events eventSinks
+}
+
+// endpointStats records the state of an endpoint's listener and connections.
+type endpointStats struct {
+	metrics endpointMetrics
+	host    string
+	name    string
+	events  eventSinks
+
+	listening int32
+	// addrs are the addresses listened on, a []string.
+	addrs  atomic.Value
+	active int64
+	// total counts every connection accepted.
+	total int64
+	// localToRemote and remoteToLocal are the bytes copied by every
+	// connection, including those still open.
+	localToRemote int64
+	remoteToLocal int64
+}
+
+// currentEnvironment returns the reported environment.
+func (s *stats) currentEnvironment() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.environment
+}
+
+// setDraining records the tunnels are draining.
+func (s *stats) setDraining() {
+	atomic.StoreInt32(&s.draining, 1)
+	drainingGauge.Set(1)
+}
+
+// setHosts replaces the reported environment and hosts.
+func (s *stats) setHosts(environment string, hosts []*hostStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.environment = environment
+	s.hosts = hosts
+}
+
+// newHostStats returns stats for host in environment and each of its
+// endpoints, sending their lifecycle events to events.
+func newHostStats(environment string, host Host, events eventSinks) *hostStats {
+	hs := &hostStats{environment: environment, events: events}
+	hs.setHost(host)
+	return hs
+}
+
+// setHost updates the host definition, retaining the stats of endpoints that
+// are still present.
+func (h *hostStats) setHost(host Host) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	endpoints := make(map[string]*endpointStats, len(host.Endpoints))
+	for _, endpoint := range host.Endpoints {
+		es, ok := h.endpoints[endpoint.Name]
+		if !ok {
+			es = h.newEndpointStats(host.Name, endpoint.Name)
+		}
+		endpoints[endpoint.Name] = es
+	}
+
+	if host.Socks == "" {
+		h.socks = nil
+	} else if h.socks == nil {
+		h.socks = h.newEndpointStats(host.Name, "socks")
+	}
+
+	if h.channelsGauge == nil {
+		h.channelsGauge = openChannels.WithLabelValues(h.environment, host.Name)
+	}
+
+	h.host = host
+	h.endpoints = endpoints
+}
+
+func (h *hostStats) newEndpointStats(host, endpoint string) *endpointStats {
+	return &endpointStats{
+		metrics: newEndpointMetrics(h.environment, host, endpoint),
+		host:    host,
+		name:    endpoint,
+		events:  h.events,
+	}
+}
+
+// Host returns the current host definition.
+func (h *hostStats) Host() Host {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.host
+}
+
+// endpoint returns the stats for the named endpoint.
+func (h *hostStats) endpoint(name string) *endpointStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.endpoints[name]
+}
+
+// socksStats returns the stats for the SOCKS proxy or nil if there isn't one.
+func (h *hostStats) socksStats() *endpointStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.socks
+}
+
+func (h *hostStats) setConnected(v bool) {
+	if atomic.SwapInt32(&h.connected, boolToInt32(v)) == boolToInt32(v) {
+		return
+	}
+	typ := EventDisconnect
+	if v {
+		typ = EventConnect
+	}
+	h.events.send(WebhookEvent{Type: typ, Host: h.Host().Name})
+}
+
+func (h *hostStats) isConnected() bool {
+	return atomic.LoadInt32(&h.connected) == 1
+}
+
+// channelOpened records a new channel, the returned func records its close.
+func (h *hostStats) channelOpened() func() {
+	atomic.AddInt64(&h.channels, 1)
+	h.channelsGauge.Inc()
+	return func() {
+		atomic.AddInt64(&h.channels, -1)
+		h.channelsGauge.Dec()
+	}
+}
+
+func (h *hostStats) openChannels() int64 {
+	return atomic.LoadInt64(&h.channels)
+}
+
+func (e *endpointStats) setListening(v bool) {
+	atomic.StoreInt32(&e.listening, boolToInt32(v))
+	if v {
+		e.events.send(WebhookEvent{Type: EventBind, Host: e.host, Endpoint: e.name})
+	} else {
+		e.addrs.Store([]string(nil))
+	}
+}
+
+// setAddrs records the addresses listened on, once they're bound.
+func (e *endpointStats) setAddrs(addrs []string) {
+	e.addrs.Store(addrs)
+}
+
+func (e *endpointStats) listenAddrs() []string {
+	addrs, _ := e.addrs.Load().([]string)
+	return addrs
+}
+
+func (e *endpointStats) isListening() bool {
+	return atomic.LoadInt32(&e.listening) == 1
+}
+
+// connOpened records a new connection, the returned connStats records its
+// bytes and close.
+func (e *endpointStats) connOpened() *connStats {
+	atomic.AddInt64(&e.active, 1)
+	atomic.AddInt64(&e.total, 1)
+	e.metrics.active.Inc()
+	e.events.send(WebhookEvent{Type: EventAccept, Host: e.host, Endpoint: e.name})
+	return &connStats{endpoint: e}
+}
+
+// connStats records a single connection through an endpoint. Its bytes are
+// counted as they're copied, so the endpoint's totals include connections
+// still open.
+type connStats struct {
+	endpoint *endpointStats
+	// localToRemote and remoteToLocal are updated atomically, by the copy in
+	// each direction.
+	localToRemote int64
+	remoteToLocal int64
+}
+
+// sent records n bytes copied from the local side to the remote side.
+func (c *connStats) sent(n int64) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.localToRemote, n)
+	atomic.AddInt64(&c.endpoint.localToRemote, n)
+	c.endpoint.metrics.localToRemote.Add(float64(n))
+}
+
+// received records n bytes copied from the remote side to the local side.
+func (c *connStats) received(n int64) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.remoteToLocal, n)
+	atomic.AddInt64(&c.endpoint.remoteToLocal, n)
+	c.endpoint.metrics.remoteToLocal.Add(float64(n))
+}
+
+// closed records the connection's close.
+func (c *connStats) closed() {
+	e := c.endpoint
+	atomic.AddInt64(&e.active, -1)
+	e.metrics.active.Dec()
+	e.events.send(WebhookEvent{
+		Type:               EventClose,
+		Host:               e.host,
+		Endpoint:           e.name,
+		BytesLocalToRemote: atomic.LoadInt64(&c.localToRemote),
+		BytesRemoteToLocal: atomic.LoadInt64(&c.remoteToLocal),
+	})
+}
+
+// dialFailed records a failure to dial the endpoint target.
+func (e *endpointStats) dialFailed() {
+	e.metrics.dialFailures.Inc()
+	e.events.send(WebhookEvent{Type: EventDialError, Host: e.host, Endpoint: e.name})
+}
+
+// rejected records a connection rejected for reason, rejectLimit or
+// rejectBreaker.
+func (e *endpointStats) rejected(reason string) {
+	e.metrics.rejected[reason].Inc()
+}
+
+func (e *endpointStats) activeConns() int64 {
+	return atomic.LoadInt64(&e.active)
+}
+
+func (e *endpointStats) totalConns() int64 {
+	return atomic.LoadInt64(&e.total)
+}
+
+func (e *endpointStats) bytesLocalToRemote() int64 {
+	return atomic.LoadInt64(&e.localToRemote)
+}
+
+func (e *endpointStats) bytesRemoteToLocal() int64 {
+	return atomic.LoadInt64(&e.remoteToLocal)
+}
+
+// healthy reports whether every host is connected and every listener is up.
+func (s *stats) healthy() bool {
+	return s.report().Healthy
+}
+
+// StatusReport is the /status response.
+type StatusReport struct {
+	Environment string `json:"environment"`
+	Healthy     bool   `json:"healthy"`
+	// Started is when the tunnels were created and UptimeSeconds the whole
+	// seconds since.
+	Started       time.Time `json:"started"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	// Draining is set once /drain has stopped the listeners, and ActiveConns
+	// counts the connections still in flight across every endpoint, so a
+	// drained instance has none.
+	Draining    bool         `json:"draining"`
+	ActiveConns int64        `json:"active_connections"`
+	Hosts       []HostStatus `json:"hosts"`
+}
+
+// HostStatus describes a host in the /status response.
+type HostStatus struct {
+	Name      string           `json:"name"`
+	Address   string           `json:"address"`
+	Connected bool             `json:"connected"`
+	Channels  int64            `json:"open_channels"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+	Socks     *EndpointStatus  `json:"socks,omitempty"`
+}
+
+// EndpointStatus describes an endpoint in the /status response.
+type EndpointStatus struct {
+	Name        string   `json:"name"`
+	LocalAddr   string   `json:"local"`
+	LocalAddrs  []string `json:"local_addrs,omitempty"`
+	RemoteAddr  string   `json:"remote,omitempty"`
+	RemoteAddrs []string `json:"remote_addrs,omitempty"`
+	Direction   string   `json:"direction"`
+	Listening   bool     `json:"listening"`
+	// ListenAddrs are the addresses listened on, as bound, so ports picked by
+	// the kernel for port 0 are filled in. On the host for remote endpoints.
+	ListenAddrs []string `json:"listen_addrs,omitempty"`
+	ActiveConns int64    `json:"active_connections"`
+	// TotalConns counts every connection accepted.
+	TotalConns int64 `json:"total_connections"`
+	// BytesLocalToRemote and BytesRemoteToLocal count the bytes copied so far,
+	// including by connections still open.
+	BytesLocalToRemote int64 `json:"bytes_local_to_remote"`
+	BytesRemoteToLocal int64 `json:"bytes_remote_to_local"`
+}
+
+// report returns a snapshot of the current state.
+func (s *stats) report() StatusReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r := StatusReport{
+		Environment:   s.environment,
+		Healthy:       true,
+		Started:       s.started,
+		UptimeSeconds: int64(time.Since(s.started).Seconds()),
+		Draining:      atomic.LoadInt32(&s.draining) == 1,
+		Hosts:         []HostStatus{},
+	}
+
+	for _, h := range s.hosts {
+		hs := h.report()
+		if !hs.healthy() {
+			r.Healthy = false
+		}
+		for _, e := range hs.Endpoints {
+			r.ActiveConns += e.ActiveConns
+		}
+		if hs.Socks != nil {
+			r.ActiveConns += hs.Socks.ActiveConns
+		}
+		r.Hosts = append(r.Hosts, hs)
+	}
+
+	return r
+}
+
+// report returns a snapshot of the host's current state.
+func (h *hostStats) report() HostStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	hs := HostStatus{
+		Name:      h.host.Name,
+		Address:   h.host.HostPort(),
+		Connected: h.isConnected(),
+		Channels:  h.openChannels(),
+		Endpoints: []EndpointStatus{},
+	}
+
+	for _, endpoint := range h.host.Endpoints {
+		e := h.endpoints[endpoint.Name]
+		direction := endpoint.Direction
+		if direction == "" {
+			direction = DirectionLocal
+		}
+		hs.Endpoints = append(hs.Endpoints, EndpointStatus{
+			Name:               endpoint.Name,
+			LocalAddr:          endpoint.LocalAddr,
+			LocalAddrs:         endpoint.LocalAddrs,
+			RemoteAddr:         endpoint.RemoteAddr,
+			RemoteAddrs:        endpoint.RemoteAddrs,
+			Direction:          direction,
+			Listening:          e.isListening(),
+			ListenAddrs:        e.listenAddrs(),
+			ActiveConns:        e.activeConns(),
+			TotalConns:         e.totalConns(),
+			BytesLocalToRemote: e.bytesLocalToRemote(),
+			BytesRemoteToLocal: e.bytesRemoteToLocal(),
+		})
+	}
+
+	if h.socks != nil {
+		hs.Socks = &EndpointStatus{
+			Name:               "socks",
+			LocalAddr:          h.host.Socks,
+			Direction:          DirectionLocal,
+			Listening:          h.socks.isListening(),
+			ListenAddrs:        h.socks.listenAddrs(),
+			ActiveConns:        h.socks.activeConns(),
+			TotalConns:         h.socks.totalConns(),
+			BytesLocalToRemote: h.socks.bytesLocalToRemote(),
+			BytesRemoteToLocal: h.socks.bytesRemoteToLocal(),
+		}
+	}
+
+	return hs
+}
+
+// healthy reports whether the host is connected and all of its listeners are up.
+func (hs HostStatus) healthy() bool {
+	if !hs.Connected {
+		return false
+	}
+	for _, e := range hs.Endpoints {
+		if !e.Listening {
+			return false
+		}
+	}
+	return hs.Socks == nil || hs.Socks.Listening
+}
+
+// newStatusHandler serves /healthz, which returns 200 only when every tunnel is
+// up, /status, which describes every host and endpoint as JSON, the Prometheus
+// /metrics and /drain, which calls drain for a POST.
+func newStatusHandler(s *stats, drain func()) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.healthy() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(s.report())
+	})
+
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		drain()
+		w.Write([]byte("draining\n"))
+	})
+
+	return mux
+}
+
+func boolToInt32(v bool) int32 {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package sshforward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// forwardStdio forwards stdin and stdout to the endpoint's remote address over
+// a single connection, like nc, instead of listening. Once either side closes,
+// or the target can't be dialled, the outcome is sent to the stdio channel of
+// opts. Cancelling ctx closes both sides, and it returns once the connection
+// has been released.
+func forwardStdio(ctx context.Context, logger *slog.Logger, client *channelClient, endpoint Endpoint, conns *connGroup, stats *endpointStats, opts *Options) {
+	done := opts.stdio
+	dial := func(network, addr string) (net.Conn, error) {
+		return client.dial(ctx, network, addr)
+	}
+
+	logger.Info("Forwarding", "from", endpoint.RemoteAddr, "to", "stdio", "direction", DirectionLocal)
+	remote, err := dialRetry(ctx, logger, dial, endpoint.RemoteAddr, endpoint.DialRetries)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the connection was lost, it's dialled again once reconnected.
+			return
+		}
+		stats.dialFailed()
+		finish(done, fmt.Errorf("dial of %v failed: %v", endpoint.RemoteAddr, err))
+		return
+	}
+	stats.setListening(true)
+	defer stats.setListening(false)
+
+	stdio := newStdioConn(os.Stdin, os.Stdout)
+	// stopping the endpoint, on shutdown or a reload, ends the connection at
+	// once, as there's no listener to stop while it drains.
+	stop := context.AfterFunc(ctx, func() {
+		stdio.Close()
+		remote.Close()
+	})
+	defer stop()
+
+	conns.add()
+	conn := stats.connOpened()
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		defer conns.done()
+		defer conn.closed()
+		handleClient(conns.ctx, logger, throttle(stdio, newThrottle(endpoint.RateLimit)), throttle(remote, newThrottle(endpoint.RateLimit)), conn, opts.buffers)
+	}()
+
+	// the forwarding is done once stdout is closed, when the remote side
+	// closes, rather than waiting for stdin to reach EOF too.
+	select {
+	case <-stdio.closed:
+		stdio.Close()
+	case <-copied:
+	}
+	<-copied
+	finish(done, nil)
+}
+
+// finish sends err to done unless it's already been sent an outcome.
+func finish(done chan<- error, err error) {
+	select {
+	case done <- err:
+	default:
+	}
+}
+
+// stdioConn is a net.Conn reading from in and writing to out, typically stdin
+// and stdout. closed is closed once out is. A read of stdin can't be
+// interrupted, so in is read through a pipe whose reads Close ends with EOF,
+// leaving the pending read of in to finish in the background.
+type stdioConn struct {
+	in     *io.PipeReader
+	inDone *io.PipeWriter
+	out    io.WriteCloser
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newStdioConn(in io.Reader, out io.WriteCloser) *stdioConn {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, in)
+		pw.CloseWithError(err)
+	}()
+	return &stdioConn{in: pr, inDone: pw, out: out, closed: make(chan struct{})}
+}
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// CloseWrite closes out so its reader sees EOF.
+func (c *stdioConn) CloseWrite() error {
+	var err error
+	c.once.Do(func() {
+		err = c.out.Close()
+		close(c.closed)
+	})
+	return err
+}
+
+func (c *stdioConn) Close() error {
+	c.inDone.Close()
+	return c.CloseWrite()
+}
+
+func (c *stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c *stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// stdioAddr is the address of a stdioConn.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return StdioAddr }
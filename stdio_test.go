@@ -0,0 +1,74 @@
+package sshforward
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestForwardStdioCancelled checks an idle stdio endpoint, whose stdin is
+// still open, stops once its context is cancelled and releases its connection.
+func TestForwardStdioCancelled(t *testing.T) {
+	client := startSSHServer(t, nil)
+	backend := startBackend(t, "127.0.0.1:0", echo)
+	endpoint := Endpoint{Name: "stdio", LocalAddr: StdioAddr, RemoteAddr: backend}
+
+	stdin, input, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, stdout, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	defer output.Close()
+	savedStdin, savedStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, stdout
+	defer func() { os.Stdin, os.Stdout = savedStdin, savedStdout }()
+
+	opts := New(ssh.ClientConfig{}, Options{}).opts
+	hs := newHostStats("test", Host{Name: "host", Endpoints: []Endpoint{endpoint}}, opts.events())
+	stats := hs.endpoint(endpoint.Name)
+	channels := &channelClient{Client: client, stats: hs}
+	conns := newConnGroup(nil)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		forwardStdio(ctx, logger, channels, endpoint, conns, stats, &opts)
+	}()
+
+	if _, err := input.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	output.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(output, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("echoed %q, want hello", got)
+	}
+
+	cancel()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwardStdio still running 5s after its context was cancelled")
+	}
+	if !conns.drain(time.Second) {
+		t.Error("connection still in flight after forwardStdio returned")
+	}
+	if got := stats.activeConns(); got != 0 {
+		t.Errorf("activeConns() = %v after forwardStdio returned, want 0", got)
+	}
+}
@@ -0,0 +1,496 @@
+package sshforward
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Options controls how hosts are supervised.
+type Options struct {
+	Reconnect Backoff
+	Grace     time.Duration
+	// KeepaliveInterval between keepalive requests, zero disables them.
+	KeepaliveInterval time.Duration
+	// KeepaliveMaxMissed is the number of consecutive keepalives that may be
+	// missed before the connection is considered dead, zero uses 3.
+	KeepaliveMaxMissed int
+	// MaxConns bounds the concurrent connections across every host, zero is
+	// unlimited.
+	MaxConns int
+	// Breaker stops each endpoint dialling its target while it's failing.
+	Breaker Breaker
+	// HideBanners stops the banners sent by hosts before authentication from
+	// being logged.
+	HideBanners bool
+	// RequireAllHosts fails Start if any host can't be connected to, rather
+	// than reconnecting it in the background.
+	RequireAllHosts bool
+	// Passwords provides password auth when publickey auth fails, nil
+	// disables it.
+	Passwords *PasswordPrompt
+	// ForwardAgent is forwarded to each host when set.
+	ForwardAgent agent.Agent
+	// SSHConfig resolves host aliases, nil disables it.
+	SSHConfig *SSHConfig
+	// Proxy is an HTTP proxy through which hosts are dialled, see ParseProxy.
+	// Nil dials them directly.
+	Proxy *url.URL
+	// Webhook is sent connection lifecycle events, see NewWebhook. Nil
+	// disables it.
+	Webhook *Webhook
+	// EventLog is written the same lifecycle events as the webhook, see
+	// NewEventLog. Nil disables it.
+	EventLog *EventLog
+	// CopyBufferSize is the size in bytes of the buffers used to copy
+	// forwarded data, zero uses 32KiB.
+	CopyBufferSize int
+	// BindRetries is the number of times a local listen that fails because
+	// the address is in use is retried, 200ms apart. Zero doesn't retry.
+	BindRetries int
+	// ListenBacklog is the listen backlog of local TCP and Unix domain socket
+	// listeners, including SOCKS proxies. Zero leaves the kernel's largest,
+	// which also caps it. It can't be set on Windows.
+	ListenBacklog int
+	// TCPNoDelay disables Nagle's algorithm on forwarded TCP connections so
+	// small writes are sent at once, and TCPKeepAlive is the period of the
+	// keepalive probes that detect their dead peers, zero disables them.
+	TCPNoDelay   bool
+	TCPKeepAlive time.Duration
+	// AcceptBackoff is the longest a listener waits before accepting again
+	// after a temporary error, such as running out of file descriptors, zero
+	// uses 1s.
+	AcceptBackoff time.Duration
+	// TargetDialTimeout bounds each dial of an endpoint's target, including
+	// the host connecting to it for the channel, zero waits indefinitely.
+	TargetDialTimeout time.Duration
+
+	// connLimit enforces MaxConns, stdio is sent the outcome of forwarding
+	// stdio and buffers pools the copy buffers, they're set by New.
+	connLimit limiter
+	stdio     chan error
+	buffers   *sync.Pool
+}
+
+// events returns the sinks the lifecycle events are sent to.
+func (o Options) events() eventSinks {
+	return eventSinks{webhook: o.Webhook, log: o.EventLog}
+}
+
+// Backoff describes the exponentially increasing delay between reconnection
+// attempts.
+type Backoff struct {
+	Delay time.Duration
+	Max   time.Duration
+	// Jitter randomises each delay by up to this fraction either way, e.g. 0.2
+	// waits between 80% and 120% of it, so hosts dropped together, or many
+	// instances started together, don't all retry at once.
+	Jitter float64
+}
+
+// next returns the delay to use after waiting d.
+func (b Backoff) next(d time.Duration) time.Duration {
+	if d == 0 {
+		return b.Delay
+	}
+	d *= 2
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// jitter returns d randomised by up to b.Jitter either way.
+func (b Backoff) jitter(d time.Duration) time.Duration {
+	if b.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*b.Jitter*float64(d))
+}
+
+// supervisor maintains the connection to a host and runs its endpoint
+// forwarders. When the connection drops the forwarders are stopped, the host is
+// re-dialled with backoff and the forwarders restarted. Host updates are
+// applied without disturbing endpoints that are unchanged.
+type supervisor struct {
+	stats    *hostStats
+	logger   *slog.Logger
+	hops     []hop
+	opts     Options
+	failures chan<- error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	conns  *connGroup
+
+	// mu guards the forwarders which are nil while disconnected, and
+	// draining, set once the listeners are stopped for good by drain.
+	mu       sync.Mutex
+	running  *forwarders
+	draining bool
+}
+
+// newSupervisor starts supervising the host in hs. If client is nil the host
+// is dialled in the background, after delay. Forwarders that fail are reported
+// to failures.
+func newSupervisor(ctx context.Context, client *ssh.Client, delay time.Duration, hs *hostStats, hops []hop, opts Options, failures chan<- error) *supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &supervisor{
+		stats:    hs,
+		logger:   slog.With("host", hs.Host().Name),
+		hops:     hops,
+		opts:     opts,
+		failures: failures,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		conns:    newConnGroup(nil),
+	}
+	go s.run(client, delay)
+	return s
+}
+
+// update replaces the host definition, the connection is left in place. When
+// update returns the forwarders of removed or changed endpoints are stopped.
+func (s *supervisor) update(host Host) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.setHost(host)
+	if s.running != nil {
+		s.reconcile()
+	}
+}
+
+// stop closes the listeners, gives in-flight connections the grace period to
+// complete and closes the connection.
+func (s *supervisor) stop() {
+	s.cancel()
+	s.wait()
+}
+
+// wait blocks until the supervisor has stopped.
+func (s *supervisor) wait() {
+	<-s.done
+}
+
+// run supervises the host until the supervisor is stopped, at which point the
+// listeners are closed and in-flight connections are given the grace period to
+// complete before the client is closed. A nil client is dialled after delay.
+func (s *supervisor) run(client *ssh.Client, delay time.Duration) {
+	defer close(s.done)
+
+	host := s.stats.Host()
+	if host.IsLocal() {
+		s.runLocal()
+		return
+	}
+	if client == nil {
+		client = redial(s.ctx, host, s.hops, s.opts.Reconnect, delay)
+		if client == nil {
+			return
+		}
+	}
+
+	for {
+		s.stats.setConnected(true)
+
+		// clientCtx is done when either the connection drops or ctx is cancelled.
+		clientCtx, cancel := context.WithCancel(s.ctx)
+		go func(client *ssh.Client) {
+			client.Wait()
+			cancel()
+		}(client)
+		interval, maxMissed := keepaliveSettings(s.stats.Host(), s.opts)
+		go keepalive(clientCtx, s.logger, client, interval, maxMissed)
+
+		if s.opts.ForwardAgent != nil {
+			if err := forwardAgent(client, s.opts.ForwardAgent); err != nil {
+				s.logger.Warn("Agent forwarding failed", "error", err)
+			}
+		}
+
+		channels := &channelClient{
+			Client:      client,
+			limit:       newLimiter(s.stats.Host().MaxChannels),
+			stats:       s.stats,
+			dialTimeout: s.opts.TargetDialTimeout,
+		}
+
+		s.mu.Lock()
+		s.running = &forwarders{
+			ctx:       clientCtx,
+			client:    channels,
+			endpoints: make(map[string]*forwarder),
+		}
+		s.reconcile()
+		s.mu.Unlock()
+
+		<-clientCtx.Done()
+		s.stats.setConnected(false)
+
+		s.mu.Lock()
+		// ensure the local ports are released before they're bound again.
+		s.running.wait()
+		s.running = nil
+		s.mu.Unlock()
+
+		host = s.stats.Host()
+		if s.ctx.Err() != nil {
+			if !s.conns.drain(s.opts.Grace) {
+				s.logger.Warn("Grace period expired, closing active connections", "address", host.HostPort())
+			}
+			s.conns.close()
+			client.Close()
+			return
+		}
+
+		s.logger.Warn("Connection lost", "address", host.HostPort())
+		client.Close()
+
+		client = redial(s.ctx, host, s.hops, s.opts.Reconnect, s.opts.Reconnect.Delay)
+		if client == nil {
+			return
+		}
+	}
+}
+
+// runLocal runs the forwarders of a local host, which dial their targets
+// directly, until the supervisor is stopped.
+func (s *supervisor) runLocal() {
+	s.stats.setConnected(true)
+	defer s.stats.setConnected(false)
+
+	s.mu.Lock()
+	s.running = &forwarders{
+		ctx:       s.ctx,
+		client:    &channelClient{stats: s.stats, dialTimeout: s.opts.TargetDialTimeout},
+		endpoints: make(map[string]*forwarder),
+	}
+	s.reconcile()
+	s.mu.Unlock()
+
+	<-s.ctx.Done()
+
+	s.mu.Lock()
+	s.running.wait()
+	s.running = nil
+	s.mu.Unlock()
+
+	if !s.conns.drain(s.opts.Grace) {
+		s.logger.Warn("Grace period expired, closing active connections")
+	}
+	s.conns.close()
+}
+
+// drain stops every listener, leaving their in-flight connections to complete,
+// and keeps endpoints from being started again, even after a reconnect. A
+// stdio endpoint has no listener and is left running.
+func (s *supervisor) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.draining = true
+	if s.running == nil {
+		return
+	}
+	for name, f := range s.running.endpoints {
+		if f.endpoint.IsStdio() {
+			continue
+		}
+		s.logger.Info("Draining endpoint", "endpoint", name)
+		f.stop()
+		delete(s.running.endpoints, name)
+	}
+	if s.running.socks != nil {
+		s.logger.Info("Draining endpoint", "endpoint", "socks")
+		s.running.socks.stop()
+		s.running.socks = nil
+	}
+}
+
+// reconcile starts forwarders for new or changed endpoints and stops those for
+// changed or removed endpoints, leaving the rest untouched. Stopped endpoints
+// accept no new connections while their in-flight connections are given the
+// grace period to complete. Nothing is started while draining. s.mu must be
+// held.
+func (s *supervisor) reconcile() {
+	if s.draining {
+		return
+	}
+	host := s.stats.Host()
+	running := s.running
+
+	wanted := make(map[string]Endpoint, len(host.Endpoints))
+	for _, endpoint := range host.Endpoints {
+		wanted[endpoint.Name] = endpoint
+	}
+
+	// stop first so the addresses of changed endpoints are free to rebind.
+	for name, f := range running.endpoints {
+		endpoint, ok := wanted[name]
+		if !ok || !reflect.DeepEqual(endpoint, f.endpoint) || f.exited() {
+			s.logger.Info("Stopping endpoint", "endpoint", name)
+			f.stop()
+			go s.retire(name, f.conns)
+			delete(running.endpoints, name)
+		}
+	}
+	if running.socks != nil && (running.socks.endpoint.LocalAddr != host.Socks || running.socks.exited()) {
+		s.logger.Info("Stopping endpoint", "endpoint", "socks")
+		running.socks.stop()
+		go s.retire("socks", running.socks.conns)
+		running.socks = nil
+	}
+
+	for _, endpoint := range host.Endpoints {
+		if _, ok := running.endpoints[endpoint.Name]; ok {
+			continue
+		}
+
+		endpoint := endpoint
+		es := s.stats.endpoint(endpoint.Name)
+		conns := newConnGroup(s.conns)
+		running.endpoints[endpoint.Name] = startForwarder(running.ctx, endpoint, conns, func(ctx context.Context) {
+			logger := s.logger.With("endpoint", endpoint.Name)
+			if endpoint.IsStdio() {
+				forwardStdio(ctx, logger, running.client, endpoint, conns, es, &s.opts)
+				return
+			}
+			err := forwardEndpoint(ctx, logger, running.client, endpoint, conns, es, &s.opts, newBreaker(s.opts.Breaker))
+			if err != nil {
+				report(ctx, s.failures, fmt.Errorf("%v/%v: %v", host.Name, endpoint.Name, err))
+			}
+		})
+	}
+
+	if running.socks == nil && host.Socks != "" {
+		es := s.stats.socksStats()
+		addr := host.Socks
+		conns := newConnGroup(s.conns)
+		running.socks = startForwarder(running.ctx, Endpoint{Name: "socks", LocalAddr: addr}, conns, func(ctx context.Context) {
+			err := serveSocks(ctx, s.logger.With("endpoint", "socks"), running.client, addr, conns, es, &s.opts)
+			if err != nil {
+				report(ctx, s.failures, fmt.Errorf("%v socks: %v", host.Name, err))
+			}
+		})
+	}
+}
+
+// retire gives the in-flight connections of the stopped endpoint the grace
+// period to complete before closing them.
+func (s *supervisor) retire(name string, conns *connGroup) {
+	if !conns.drain(s.opts.Grace) {
+		s.logger.Warn("Grace period expired, closing active connections", "endpoint", name)
+	}
+	conns.close()
+}
+
+// forwarders are the running listeners for a host's connection.
+type forwarders struct {
+	// ctx is done when the connection is lost.
+	ctx       context.Context
+	client    *channelClient
+	endpoints map[string]*forwarder
+	// socks is nil unless a SOCKS proxy is running.
+	socks *forwarder
+}
+
+// wait blocks until every forwarder has returned.
+func (fs *forwarders) wait() {
+	for _, f := range fs.endpoints {
+		f.wait()
+	}
+	if fs.socks != nil {
+		fs.socks.wait()
+	}
+}
+
+// forwarder is a running listener.
+type forwarder struct {
+	endpoint Endpoint
+	// conns are the connections accepted by the listener, which outlive it.
+	conns  *connGroup
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startForwarder runs fn for endpoint until the returned forwarder is stopped
+// or ctx is done.
+func startForwarder(ctx context.Context, endpoint Endpoint, conns *connGroup, fn func(context.Context)) *forwarder {
+	ctx, cancel := context.WithCancel(ctx)
+	f := &forwarder{
+		endpoint: endpoint,
+		conns:    conns,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(f.done)
+		fn(ctx)
+	}()
+	return f
+}
+
+// stop closes the listener and waits for the forwarder to return.
+func (f *forwarder) stop() {
+	f.cancel()
+	f.wait()
+}
+
+// wait blocks until the forwarder returns.
+func (f *forwarder) wait() {
+	<-f.done
+}
+
+// exited reports whether the forwarder has returned, typically because its
+// listener failed.
+func (f *forwarder) exited() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// report sends err to failures unless ctx is cancelled first, so a stopped
+// forwarder never blocks on an unread failure.
+func report(ctx context.Context, failures chan<- error, err error) {
+	select {
+	case failures <- err:
+	case <-ctx.Done():
+	}
+}
+
+// redial connects to host with backoff, waiting delay before the first attempt,
+// until it succeeds or ctx is cancelled, in which case nil is returned. Each
+// wait is jittered.
+func redial(ctx context.Context, host Host, hops []hop, reconnect Backoff, delay time.Duration) *ssh.Client {
+	wait := reconnect.jitter(delay)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		slog.Info("Connecting", "host", host.Name, "address", hops[len(hops)-1].Address)
+		client, err := dialRoute(hops)
+		if err == nil {
+			return client
+		}
+		delay = reconnect.next(delay)
+		wait = reconnect.jitter(delay)
+		slog.Warn("Failed to connect", "host", host.Name, "address", hops[len(hops)-1].Address, "error", err, "retry_in", wait)
+	}
+}
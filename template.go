@@ -0,0 +1,77 @@
+package sshforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// remoteVars are the variables of a remote address template, see expandRemote.
+var remoteVars = []string{"{local_host}", "{local_port}", "{client_host}"}
+
+// isRemoteTemplate reports whether addr is a remote address template.
+func isRemoteTemplate(addr string) bool {
+	return strings.Contains(addr, "{")
+}
+
+// expandRemote returns the remote address template addr for a connection
+// accepted on the local address from the client address. {local_host} and
+// {local_port} are replaced by the host and port the connection was accepted
+// on and {client_host} by the client's host. IPv6 hosts are bracketed, as by
+// net.JoinHostPort, so {local_host}:80 is a valid address either way.
+func expandRemote(addr, local, client string) string {
+	localHost, localPort, _ := net.SplitHostPort(local)
+	clientHost, _, _ := net.SplitHostPort(client)
+	localHost, clientHost = bracketHost(localHost), bracketHost(clientHost)
+	return strings.NewReplacer(
+		// templates that already bracket the host aren't bracketed twice.
+		"[{local_host}]", localHost,
+		"[{client_host}]", clientHost,
+		"{local_host}", localHost,
+		"{local_port}", localPort,
+		"{client_host}", clientHost,
+	).Replace(addr)
+}
+
+// bracketHost returns host in brackets if it's an IPv6 address.
+func bracketHost(host string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// expandTemplate returns the distinct addresses the template addr expands to
+// for connections to each of the local addresses, standing in the local host
+// for {client_host}.
+func expandTemplate(addr string, locals []string) ([]string, error) {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, spec := range locals {
+		expanded, err := expandPortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, local := range expanded {
+			a := expandRemote(addr, local, local)
+			if !seen[a] {
+				seen[a] = true
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// validateRemoteTemplate checks the template addr only uses known variables
+// and expands to a valid address.
+func validateRemoteTemplate(addr string) error {
+	sample := expandRemote(addr, "127.0.0.1:1", "127.0.0.1:1")
+	if strings.ContainsAny(sample, "{}") {
+		return fmt.Errorf("%q has an unknown variable, expected one of %v", addr, strings.Join(remoteVars, ", "))
+	}
+	if err := validateAddr(sample); err != nil {
+		return fmt.Errorf("template %v", err)
+	}
+	return nil
+}
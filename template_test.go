@@ -0,0 +1,28 @@
+package sshforward
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExpandRemote(t *testing.T) {
+	tests := []struct {
+		template, local, client, want string
+	}{
+		{"backend:{local_port}", "127.0.0.1:9001", "127.0.0.1:5555", "backend:9001"},
+		{"{local_host}:80", "127.0.0.1:9001", "127.0.0.1:5555", "127.0.0.1:80"},
+		{"{local_host}:80", "[::1]:9001", "[::1]:5555", "[::1]:80"},
+		{"[{local_host}]:80", "[::1]:9001", "[::1]:5555", "[::1]:80"},
+		{"{client_host}:{local_port}", "[::1]:9001", "[fe80::1]:5555", "[fe80::1]:9001"},
+		{"[{client_host}]:22", "127.0.0.1:9001", "10.0.0.7:5555", "10.0.0.7:22"},
+	}
+	for _, tt := range tests {
+		got := expandRemote(tt.template, tt.local, tt.client)
+		if got != tt.want {
+			t.Errorf("expandRemote(%q, %q, %q) = %q, want %q", tt.template, tt.local, tt.client, got, tt.want)
+		}
+		if _, _, err := net.SplitHostPort(got); err != nil {
+			t.Errorf("expandRemote(%q, %q, %q) = %q, an invalid address: %v", tt.template, tt.local, tt.client, got, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package sshforward
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// newThrottle returns a limiter allowing bytesPerSec bytes a second, or nil
+// when bytesPerSec isn't positive.
+func newThrottle(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// throttle returns conn with its reads limited by lim, or conn itself when lim
+// is nil. A limiter may be shared to bound the combined rate of several
+// connections.
+func throttle(conn net.Conn, lim *rate.Limiter) net.Conn {
+	if lim == nil {
+		return conn
+	}
+	return &throttledConn{Conn: conn, lim: lim}
+}
+
+// throttledConn is a net.Conn whose reads wait for the limiter.
+type throttledConn struct {
+	net.Conn
+	lim *rate.Limiter
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if burst := c.lim.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		// the conn's own errors take precedence, the wait can't fail as n is
+		// within the burst.
+		c.lim.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying conn where it's supported.
+func (c *throttledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
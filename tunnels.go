@@ -0,0 +1,414 @@
+// Package sshforward forwards local and remote ports over ssh connections to
+// the hosts of a Config, reconnecting them when they drop. The sshforward
+// command in cmd/sshforward wraps it with flags, signals and a status server.
+package sshforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tunnels runs a supervisor for each host in the config and applies config
+// reloads to them.
+type Tunnels struct {
+	base     ssh.ClientConfig
+	opts     Options
+	failures chan error
+	stats    stats
+
+	mu          sync.Mutex
+	supervisors map[string]*supervisor
+	// draining is set by Drain, after which reloads are ignored.
+	draining bool
+}
+
+// New returns the tunnels for hosts dialled with base, which provides the
+// default user, auth methods, host key callback and timeout. Nothing is
+// connected until they're started.
+func New(base ssh.ClientConfig, opts Options) *Tunnels {
+	if opts.CopyBufferSize <= 0 {
+		opts.CopyBufferSize = defaultCopyBufferSize
+	}
+	if opts.AcceptBackoff <= 0 {
+		opts.AcceptBackoff = defaultAcceptBackoff
+	}
+	if opts.KeepaliveMaxMissed <= 0 {
+		opts.KeepaliveMaxMissed = defaultKeepaliveMaxMissed
+	}
+	opts.connLimit = newLimiter(opts.MaxConns)
+	opts.stdio = make(chan error, 1)
+	opts.buffers = newCopyBuffers(opts.CopyBufferSize)
+	return &Tunnels{
+		base:        base,
+		opts:        opts,
+		failures:    make(chan error),
+		stats:       stats{started: time.Now()},
+		supervisors: make(map[string]*supervisor),
+	}
+}
+
+// Check validates config and ensures every host has a user.
+func (t *Tunnels) Check(config Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	for _, host := range config.Hosts {
+		if host.IsLocal() {
+			continue
+		}
+		host = t.opts.SSHConfig.resolve(host)
+		if host.User == "" && t.base.User == "" {
+			return fmt.Errorf("no user for %v, set its user or use -u", host.Name)
+		}
+	}
+
+	return nil
+}
+
+// Probe connects to every host in config concurrently and disconnects again,
+// without forwarding any endpoints, failing if any can't be reached. Local
+// hosts aren't connected to.
+func (t *Tunnels) Probe(config Config) error {
+	hosts := config.enabledHosts()
+	errs := make([]error, len(hosts))
+
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		if host.IsLocal() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, host Host) {
+			defer wg.Done()
+			hops := route(config.Hosts, host, t.base, t.opts)
+			addr := hops[len(hops)-1].Address
+			client, err := dialRoute(hops)
+			if err != nil {
+				slog.Error("Host unreachable", "host", host.Name, "address", addr, "error", err)
+				errs[i] = fmt.Errorf("failed to connect to %v <%v>: %v", host.Name, addr, err)
+				return
+			}
+			client.Close()
+			slog.Info("Host reachable", "host", host.Name, "address", addr)
+		}(i, host)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// TestEndpoint connects to the host of the named endpoint and dials its target
+// once, logging the time each dial took, then disconnects. The name is either
+// host/endpoint or an endpoint name used by only one host. Local endpoints
+// dial their remote addresses through the host, remote endpoints dial their
+// local address directly. Disabled hosts and endpoints can be tested too.
+func (t *Tunnels) TestEndpoint(config Config, name string) error {
+	host, endpoint, err := config.findEndpoint(name)
+	if err != nil {
+		return err
+	}
+	logger := slog.With("host", host.Name, "endpoint", endpoint.Name)
+
+	dialDirect := func(network, addr string) (net.Conn, error) {
+		return dialTarget(context.Background(), nil, network, addr, t.opts.TargetDialTimeout)
+	}
+	dial, target := dialDirect, endpoint.RemoteAddr
+	if !host.IsLocal() {
+		hops := route(config.Hosts, host, t.base, t.opts)
+		addr := hops[len(hops)-1].Address
+		start := time.Now()
+		client, err := dialRoute(hops)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %v <%v>: %v", host.Name, addr, err)
+		}
+		defer client.Close()
+		logger.Info("Host reachable", "address", addr, "duration", time.Since(start))
+		dial = func(network, addr string) (net.Conn, error) {
+			return dialTarget(context.Background(), client, network, addr, t.opts.TargetDialTimeout)
+		}
+	}
+	if endpoint.Direction == DirectionRemote {
+		dial, target = dialDirect, endpoint.LocalAddr
+	}
+	targets, err := expandPortRange(target)
+	if err != nil {
+		return err
+	}
+	if isRemoteTemplate(target) {
+		targets, err = expandTemplate(target, endpoint.localAddrs())
+		if err != nil {
+			return err
+		}
+	}
+	if endpoint.Direction != DirectionRemote {
+		targets = append(targets, endpoint.RemoteAddrs...)
+	}
+
+	var failed []string
+	for _, target := range targets {
+		start := time.Now()
+		conn, err := dial(splitNetwork(target))
+		if err != nil {
+			logger.Error("Target unreachable", "address", target, "error", err)
+			failed = append(failed, fmt.Sprintf("failed to dial %v: %v", target, err))
+			continue
+		}
+		conn.Close()
+		logger.Info("Target reachable", "address", target, "round_trip", time.Since(start))
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// Start connects to every host in config concurrently and supervises them
+// until ctx is cancelled. Each host's forwarders start as soon as it connects.
+// Hosts that can't be reached are logged and reconnected in the background,
+// unless Options.RequireAllHosts is set in which case Start fails, having
+// stopped the hosts that did connect.
+func (t *Tunnels) Start(ctx context.Context, config Config) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hosts := config.enabledHosts()
+	hostStats := make([]*hostStats, len(hosts))
+	errs := make([]error, len(hosts))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host Host) {
+			defer wg.Done()
+			hops := route(config.Hosts, host, t.base, t.opts)
+
+			var client *ssh.Client
+			if !host.IsLocal() {
+				addr := hops[len(hops)-1].Address
+				slog.Info("Connecting", "host", host.Name, "user", hops[len(hops)-1].Config.User, "address", addr)
+				var err error
+				client, err = dialRoute(hops)
+				if err != nil {
+					errs[i] = fmt.Errorf("failed to connect to %v <%v>: %v", host.Name, addr, err)
+					if t.opts.RequireAllHosts {
+						return
+					}
+					slog.Warn("Failed to connect, retrying in the background", "host", host.Name, "address", addr, "error", err)
+				}
+			}
+
+			hostStats[i] = newHostStats(config.Environment, host, t.opts.events())
+			// a failed host is retried after the reconnect delay.
+			s := newSupervisor(ctx, client, t.opts.Reconnect.Delay, hostStats[i], hops, t.opts, t.failures)
+
+			mu.Lock()
+			t.supervisors[host.Name] = s
+			mu.Unlock()
+		}(i, host)
+	}
+	wg.Wait()
+
+	var connected []string
+	var failed []string
+	for i, host := range hosts {
+		if errs[i] != nil {
+			failed = append(failed, errs[i].Error())
+			continue
+		}
+		connected = append(connected, host.Name)
+	}
+	slog.Info("Connected to hosts", "connected", len(connected), "total", len(hosts), "hosts", connected)
+
+	if len(failed) > 0 && t.opts.RequireAllHosts {
+		// the hosts that did connect mustn't be left forwarding.
+		t.stop()
+		t.supervisors = make(map[string]*supervisor)
+		return errors.New(strings.Join(failed, "\n"))
+	}
+
+	t.stats.setHosts(config.Environment, hostStats)
+	return nil
+}
+
+// Reload applies config to the running hosts. Hosts that are removed, or
+// whose connection details change, are stopped. Hosts that are added are
+// connected in the background and the endpoints of the remaining hosts are
+// updated in place.
+func (t *Tunnels) Reload(ctx context.Context, config Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		slog.Warn("Draining, ignoring reload")
+		return
+	}
+
+	enabled := config.enabledHosts()
+	routes := make(map[string][]hop, len(enabled))
+	hosts := make(map[string]Host, len(enabled))
+	for _, host := range enabled {
+		routes[host.Name] = route(config.Hosts, host, t.base, t.opts)
+		hosts[host.Name] = host
+	}
+
+	// a new environment restarts every host so its metrics are relabelled.
+	sameEnvironment := config.Environment == t.stats.currentEnvironment()
+
+	// Stop first so the addresses of removed endpoints are free to rebind.
+	for name, s := range t.supervisors {
+		hops, ok := routes[name]
+		if !ok || !sameEnvironment || !sameRoute(hops, s.hops) || !sameConnection(s.stats.Host(), hosts[name]) {
+			slog.Info("Stopping host", "host", name)
+			s.stop()
+			delete(t.supervisors, name)
+		}
+	}
+
+	var hostStats []*hostStats
+	for _, host := range enabled {
+		s, ok := t.supervisors[host.Name]
+		if ok {
+			s.update(host)
+		} else {
+			slog.Info("Starting host", "host", host.Name)
+			s = newSupervisor(ctx, nil, 0, newHostStats(config.Environment, host, t.opts.events()), routes[host.Name], t.opts, t.failures)
+			t.supervisors[host.Name] = s
+		}
+		hostStats = append(hostStats, s.stats)
+	}
+
+	t.stats.setHosts(config.Environment, hostStats)
+}
+
+// Stop closes every host's listeners and waits for their in-flight connections
+// to complete within the grace period.
+func (t *Tunnels) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+}
+
+// stop stops every host and waits for them, t.mu must be held.
+func (t *Tunnels) stop() {
+	for _, s := range t.supervisors {
+		s.cancel()
+	}
+	for _, s := range t.supervisors {
+		s.wait()
+	}
+}
+
+// Run checks and starts config, forwarding its endpoints until ctx is done and
+// then stopping. Endpoint failures are logged, use Start and Failures instead
+// to act on them.
+func (t *Tunnels) Run(ctx context.Context, config Config) error {
+	if err := t.Check(config); err != nil {
+		return err
+	}
+	if err := t.Start(ctx, config); err != nil {
+		t.Stop()
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case err := <-t.failures:
+			slog.Error("Endpoint failed", "error", err)
+		}
+	}
+}
+
+// Failures reports the endpoints that fail once started. It must be received
+// from while the tunnels are running, unless they're run with Run.
+func (t *Tunnels) Failures() <-chan error {
+	return t.failures
+}
+
+// StdioDone reports the outcome of an endpoint forwarding stdin and stdout,
+// see StdioAddr: nil once either side has closed or the error dialling its
+// target. Nothing is sent without such an endpoint.
+func (t *Tunnels) StdioDone() <-chan error {
+	return t.opts.stdio
+}
+
+// Healthy reports whether every host is connected and every endpoint is
+// listening.
+func (t *Tunnels) Healthy() bool {
+	return t.stats.healthy()
+}
+
+// Status reports the state of every host and endpoint.
+func (t *Tunnels) Status() StatusReport {
+	return t.stats.report()
+}
+
+// Drain stops accepting connections on every endpoint while those in flight
+// are left to complete, e.g. to hand over to a replacement instance. The hosts
+// stay connected, and reconnect, to carry them. Draining can't be undone, the
+// tunnels are stopped as usual once the connections have completed.
+func (t *Tunnels) Drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return
+	}
+	slog.Info("Draining, no longer accepting connections")
+	t.draining = true
+	t.stats.setDraining()
+	for _, s := range t.supervisors {
+		s.drain()
+	}
+}
+
+// StatusHandler serves the /healthz, /status, /metrics and /drain endpoints.
+func (t *Tunnels) StatusHandler() http.Handler {
+	return newStatusHandler(&t.stats, t.Drain)
+}
+
+// sameConnection reports whether a and b limit and keep alive the connection
+// the same way.
+func sameConnection(a, b Host) bool {
+	return a.MaxChannels == b.MaxChannels && a.KeepaliveInterval == b.KeepaliveInterval &&
+		a.KeepaliveMaxMissed == b.KeepaliveMaxMissed
+}
+
+// sameRoute reports whether a and b connect to the same addresses as the same
+// users, with the same pinned host keys, algorithms and timeouts.
+func sameRoute(a, b []hop) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Address != b[i].Address || a[i].Config.User != b[i].Config.User || a[i].HostKey != b[i].HostKey ||
+			a[i].Config.Timeout != b[i].Config.Timeout || !reflect.DeepEqual(a[i].Config.Config, b[i].Config.Config) {
+			return false
+		}
+	}
+	return true
+}
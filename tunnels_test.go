@@ -0,0 +1,53 @@
+package sshforward
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestStartRequireAllHostsStops checks the hosts that connected are stopped,
+// their listeners released, when Start fails for a host that didn't.
+func TestStartRequireAllHostsStops(t *testing.T) {
+	addr, hostKey := listenSSH(t, nil)
+	backend := startBackend(t, "127.0.0.1:0", echo)
+	local := freeAddr(t)
+	config := Config{
+		Environment: "test",
+		Hosts: []Host{
+			{Name: "up", Address: addr, User: "test", Endpoints: []Endpoint{{Name: "echo", LocalAddr: local, RemoteAddr: backend}}},
+			// nothing listens on the port.
+			{Name: "down", Address: freeAddr(t), User: "test"},
+		},
+	}
+	tunnels := New(ssh.ClientConfig{HostKeyCallback: ssh.FixedHostKey(hostKey), Timeout: 5 * time.Second}, Options{RequireAllHosts: true})
+	if err := tunnels.Check(config); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := tunnels.Start(ctx, config); err == nil {
+		tunnels.Stop()
+		t.Fatal("Start() succeeded with a host down")
+	}
+
+	// the up host's listener would be bound within this time were it running.
+	for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", local); err == nil {
+			conn.Close()
+			t.Fatalf("%v is still listening after Start failed", local)
+		}
+	}
+	l, err := net.Listen("tcp", local)
+	if err != nil {
+		t.Fatalf("%v wasn't released: %v", local, err)
+	}
+	l.Close()
+	if got := len(tunnels.supervisors); got != 0 {
+		t.Errorf("%v hosts still supervised, want 0", got)
+	}
+}
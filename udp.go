@@ -0,0 +1,252 @@
+package sshforward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// udpSessionTimeout closes a UDP session that has seen no datagrams in either
+// direction for this long, unless the endpoint has an idle_timeout.
+const udpSessionTimeout = time.Minute
+
+// maxDatagram is the largest UDP payload, which is also the largest that fits
+// the 2 byte length of a frame.
+const maxDatagram = 65535
+
+// udpSession is the ssh channel carrying the datagrams of one UDP client.
+type udpSession struct {
+	conn     net.Conn
+	activity *activity
+	// stats is added to as datagrams are relayed each way.
+	stats *connStats
+}
+
+// forwardUDP forwards datagrams received on the endpoint's local UDP address
+// over ssh channels to its remote TCP address, until ctx is done or the
+// connection is lost. Each client address gets its own channel, a session,
+// over which datagrams are framed with a 2 byte big-endian length as in DNS
+// over TCP. Replies are framed the same way and sent back to the client.
+// Sessions are tracked in conns, limited like connections and closed once
+// idle. Sessions aren't started while brk is open.
+func forwardUDP(ctx context.Context, logger *slog.Logger, client *channelClient, endpoint Endpoint, conns *connGroup, stats *endpointStats, opts *Options, brk *breaker) error {
+	dial := func(network, addr string) (net.Conn, error) {
+		return client.dial(ctx, network, addr)
+	}
+
+	if endpoint.Probe {
+		conn, err := dial("tcp", endpoint.RemoteAddr)
+		if err != nil {
+			return fmt.Errorf("probe of %v failed: %v", endpoint.RemoteAddr, err)
+		}
+		conn.Close()
+	}
+
+	pc, err := net.ListenPacket("udp", endpoint.LocalAddr)
+	if err != nil {
+		return fmt.Errorf("forwarding port bind error: %v", err)
+	}
+	logger.Info("Forwarding", "from", endpoint.RemoteAddr, "to", pc.LocalAddr().String(), "direction", DirectionLocal, "protocol", ProtocolUDP)
+	stats.setAddrs([]string{pc.LocalAddr().String()})
+	stats.setListening(true)
+	defer stats.setListening(false)
+
+	// stop receiving once the ssh connection is lost or we're shutting down.
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	allow, err := parseAllowList(endpoint.Allow)
+	if err != nil {
+		return err
+	}
+	limit := newLimiter(endpoint.MaxConns)
+	timeout := udpSessionTimeout
+	if endpoint.IdleTimeout > 0 {
+		timeout = time.Duration(endpoint.IdleTimeout) * time.Second
+	}
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("udp read error: %v", err)
+		}
+
+		mu.Lock()
+		s, ok := sessions[src.String()]
+		mu.Unlock()
+
+		if !ok {
+			if !allow.allows(src) {
+				logger.Warn("Source not allowed, dropping datagram", "client", src.String())
+				continue
+			}
+			// acquired before the breaker is asked, as in forwardEndpoint.
+			released, ok := acquire(limit, opts.connLimit)
+			if !ok {
+				logger.Warn("Connection limit reached, dropping datagram", "client", src.String())
+				stats.rejected(rejectLimit)
+				continue
+			}
+			if !brk.allow() {
+				logger.Info("Target failing, dropping datagram", "client", src.String(), "address", endpoint.RemoteAddr)
+				stats.rejected(rejectBreaker)
+				released()
+				continue
+			}
+
+			// datagrams from other clients wait for the dial, it's best effort.
+			remote, err := dialRetry(ctx, logger, dial, endpoint.RemoteAddr, endpoint.DialRetries)
+			if err != nil {
+				logger.Warn("Dial failed", "address", endpoint.RemoteAddr, "error", err)
+				stats.dialFailed()
+				brk.dialFailed(logger, endpoint.RemoteAddr)
+				released()
+				continue
+			}
+			brk.dialled(logger, endpoint.RemoteAddr)
+			logger.Debug("UDP session started", "client", src.String())
+
+			conns.add()
+			conn := stats.connOpened()
+			a := newActivity()
+			s = &udpSession{conn: a.conn(remote), activity: a, stats: conn}
+			mu.Lock()
+			sessions[src.String()] = s
+			mu.Unlock()
+
+			go func(src net.Addr) {
+				defer conns.done()
+				defer conn.closed()
+				defer released()
+
+				stopWatching := a.watch(timeout, func() {
+					logger.Debug("Closing idle UDP session", "client", src.String(), "idle_timeout", timeout)
+					s.conn.Close()
+				})
+				defer stopWatching()
+				stop := context.AfterFunc(conns.ctx, func() {
+					s.conn.Close()
+				})
+				defer stop()
+
+				relayFrames(pc, src, s.conn, conn)
+
+				mu.Lock()
+				delete(sessions, src.String())
+				mu.Unlock()
+				s.conn.Close()
+			}(src)
+		}
+
+		s.activity.touch()
+		if err := writeFrame(s.conn, buf[:n]); err != nil {
+			// the session's goroutine removes it once the read fails.
+			s.conn.Close()
+			continue
+		}
+		s.stats.sent(int64(n))
+	}
+}
+
+// relayFrames sends each frame read from conn as a datagram to dst on pc until
+// conn is closed, recording the bytes sent as received in stats.
+func relayFrames(pc net.PacketConn, dst net.Addr, conn net.Conn, stats *connStats) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := readFrame(conn, buf)
+		if err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(buf[:n], dst); err != nil {
+			return
+		}
+		stats.received(int64(n))
+	}
+}
+
+// writeFrame writes p to w prefixed with its 2 byte big-endian length.
+func writeFrame(w io.Writer, p []byte) error {
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a frame written by writeFrame from r into buf, which must
+// hold maxDatagram bytes, and returns its length.
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(r, buf[:n])
+	return n, err
+}
+
+// RelayUDP is the remote counterpart of a udp endpoint. It accepts the framed
+// sessions of udp endpoints on l and relays their datagrams to the UDP service
+// at target, framing its replies back, until l is closed.
+func RelayUDP(l net.Listener, target string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			udp, err := net.Dial("udp", target)
+			if err != nil {
+				slog.Warn("Dial failed", "address", target, "error", err)
+				return
+			}
+			defer udp.Close()
+
+			// closing either side stops the other.
+			go func() {
+				buf := make([]byte, maxDatagram)
+				for {
+					n, err := udp.Read(buf)
+					if errors.Is(err, syscall.ECONNREFUSED) {
+						// a datagram wasn't delivered, the next may be.
+						continue
+					}
+					if err != nil || writeFrame(conn, buf[:n]) != nil {
+						conn.Close()
+						return
+					}
+				}
+			}()
+
+			buf := make([]byte, maxDatagram)
+			for {
+				n, err := readFrame(conn, buf)
+				if err != nil {
+					return
+				}
+				if _, err := udp.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,157 @@
+package sshforward
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// warmMaxAge is how long a pre-dialled connection is kept before it's
+	// replaced, so targets that close idle connections don't hand out dead
+	// ones.
+	warmMaxAge = 30 * time.Second
+	// warmRetryDelay is the wait before dialling again after a pre-dial fails.
+	warmRetryDelay = time.Second
+)
+
+// warmPool keeps connections to an endpoint's target dialled ahead of need, so
+// accepted connections needn't wait for the dial. Connections are replenished
+// in the background as they're handed out or age. A nil pool is always empty.
+type warmPool struct {
+	size int
+	addr string
+	dial func(network, addr string) (net.Conn, error)
+	// tune is applied to each connection once it's dialled.
+	tune func(net.Conn)
+
+	mu    sync.Mutex
+	conns []warmConn
+	// refill wakes the background dialler once a connection is taken.
+	refill chan struct{}
+}
+
+// warmConn is a pre-dialled connection and when it was dialled.
+type warmConn struct {
+	net.Conn
+	dialled time.Time
+}
+
+// newWarmPool starts keeping size connections to addr dialled until ctx is
+// done, at which point those not handed out are closed. It returns nil when
+// size isn't positive.
+func newWarmPool(ctx context.Context, logger *slog.Logger, size int, dial func(network, addr string) (net.Conn, error), addr string, tune func(net.Conn)) *warmPool {
+	if size <= 0 {
+		return nil
+	}
+	p := &warmPool{size: size, addr: addr, dial: dial, tune: tune, refill: make(chan struct{}, 1)}
+	go p.run(ctx, logger)
+	return p
+}
+
+// get returns a pre-dialled connection, or nil if there are none.
+func (p *warmPool) get() net.Conn {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.conns) > 0 {
+		c := p.conns[0]
+		p.conns = p.conns[1:]
+		if time.Since(c.dialled) < warmMaxAge {
+			p.wake()
+			return c.Conn
+		}
+		c.Close()
+	}
+	p.wake()
+	return nil
+}
+
+// wake has the background dialler top up the pool, without blocking.
+func (p *warmPool) wake() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps the pool topped up, replacing connections as they age, until ctx
+// is done.
+func (p *warmPool) run(ctx context.Context, logger *slog.Logger) {
+	ticker := time.NewTicker(warmMaxAge / 2)
+	defer ticker.Stop()
+
+	for {
+		if !p.fill(ctx, logger) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			p.close()
+			return
+		case <-p.refill:
+		case <-ticker.C:
+		}
+	}
+}
+
+// fill closes aged connections and dials until the pool is full, reporting
+// false once ctx is done.
+func (p *warmPool) fill(ctx context.Context, logger *slog.Logger) bool {
+	for {
+		p.mu.Lock()
+		fresh := p.conns[:0]
+		for _, c := range p.conns {
+			if time.Since(c.dialled) < warmMaxAge {
+				fresh = append(fresh, c)
+			} else {
+				c.Close()
+			}
+		}
+		p.conns = fresh
+		full := len(p.conns) >= p.size
+		p.mu.Unlock()
+		if full {
+			return true
+		}
+
+		conn, err := p.dial(splitNetwork(p.addr))
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			p.close()
+			return false
+		}
+		if err != nil {
+			logger.Debug("Pre-dial failed", "address", p.addr, "error", err)
+			select {
+			case <-ctx.Done():
+				p.close()
+				return false
+			case <-time.After(warmRetryDelay):
+			}
+			continue
+		}
+		p.tune(conn)
+
+		p.mu.Lock()
+		p.conns = append(p.conns, warmConn{Conn: conn, dialled: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+// close closes the connections not handed out.
+func (p *warmPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
@@ -0,0 +1,165 @@
+package sshforward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The types of lifecycle event, sent to webhooks and event logs.
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventBind       = "bind"
+	EventAccept     = "accept"
+	EventClose      = "close"
+	EventDialError  = "dial-error"
+)
+
+const (
+	// webhookQueue bounds the events waiting to be sent, further events are
+	// dropped.
+	webhookQueue = 1024
+	// webhookBatch is the most events sent in a single request.
+	webhookBatch = 100
+	// webhookInterval is how often queued events are sent.
+	webhookInterval = time.Second
+	// webhookTimeout bounds each request.
+	webhookTimeout = 10 * time.Second
+)
+
+// WebhookEvent is a lifecycle event sent to a webhook or event log. Endpoint
+// is empty for connect and disconnect events.
+type WebhookEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Host     string    `json:"host"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	// BytesLocalToRemote and BytesRemoteToLocal are the bytes copied by the
+	// connection, only set for close events.
+	BytesLocalToRemote int64 `json:"bytes_local_to_remote,omitempty"`
+	BytesRemoteToLocal int64 `json:"bytes_remote_to_local,omitempty"`
+}
+
+// Webhook POSTs connection lifecycle events to a URL as JSON arrays, batching
+// those that occur within a second of each other. Events are queued without
+// blocking and dropped while the queue is full, so a slow webhook never holds
+// up forwarding.
+type Webhook struct {
+	url    string
+	client *http.Client
+	events chan WebhookEvent
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewWebhook returns a webhook posting to the http or https URL raw.
+func NewWebhook(raw string) (*Webhook, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webhook %v must be an http:// or https:// URL", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("webhook %v has no host", raw)
+	}
+
+	w := &Webhook{
+		url:    u.String(),
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan WebhookEvent, webhookQueue),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close sends any queued events and stops the webhook.
+func (w *Webhook) Close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
+
+// send queues an event, doing nothing if w is nil.
+func (w *Webhook) send(e WebhookEvent) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.events <- e:
+	default:
+	}
+}
+
+// run sends the queued events every webhookInterval until stopped.
+func (w *Webhook) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.stop:
+			w.flush()
+			return
+		}
+	}
+}
+
+// flush sends the queued events in batches of up to webhookBatch.
+func (w *Webhook) flush() {
+	for {
+		batch := make([]WebhookEvent, 0, webhookBatch)
+	queued:
+		for len(batch) < webhookBatch {
+			select {
+			case e := <-w.events:
+				batch = append(batch, e)
+			default:
+				break queued
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := w.post(batch); err != nil {
+			// drop the batch rather than let a failing webhook back up.
+			slog.Warn("Webhook failed", "events", len(batch), "error", err)
+		}
+		if len(batch) < webhookBatch {
+			return
+		}
+	}
+}
+
+// post sends a batch of events.
+func (w *Webhook) post(batch []WebhookEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded %v", resp.Status)
+	}
+	return nil
+}